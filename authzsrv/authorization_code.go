@@ -0,0 +1,193 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gostack/option"
+	"github.com/satori/go.uuid"
+)
+
+// DefaultAuthorizationCodeLifetime is the lifetime of authorization codes when none is configured
+// in the AuthorizationCode strategy.
+const DefaultAuthorizationCodeLifetime = 1 * time.Minute
+
+// AuthorizationCode implement the standard OAuth2 Authorization Code grant type as described by
+// https://tools.ietf.org/html/rfc6749#section-4.1
+//
+// The Persistence provided to the Server must also implement AuthorizationCodePersistence.
+type AuthorizationCode struct {
+	// CodeLifetime is the duration for which issued codes can be exchanged for an access token.
+	CodeLifetime time.Duration
+
+	// ForbidPlainCodeChallenge rejects PKCE requests using the plain code challenge method, only
+	// allowing S256.
+	ForbidPlainCodeChallenge bool
+}
+
+// ResponseType registers the code response type for AuthorizationCode.
+func (s AuthorizationCode) ResponseType(p Persistence) (option.String, AuthorizationResponseType) {
+	lifetime := s.CodeLifetime
+	if lifetime == 0 {
+		lifetime = DefaultAuthorizationCodeLifetime
+	}
+
+	rt := AuthorizationCodeResponseType{
+		SaverAuthorizationCode:   authorizationCodePersistence(p),
+		lifetime:                 lifetime,
+		forbidPlainCodeChallenge: s.ForbidPlainCodeChallenge,
+	}
+
+	return option.SomeString("code"), rt
+}
+
+// GrantType registers the authorization_code grant type for AuthorizationCode.
+func (s AuthorizationCode) GrantType(p Persistence) (option.String, TokenGrantType) {
+	return option.SomeString("authorization_code"), AuthorizationCodeGrantType{authorizationCodePersistence(p)}
+}
+
+func authorizationCodePersistence(p Persistence) AuthorizationCodePersistence {
+	cp, ok := p.(AuthorizationCodePersistence)
+	if !ok {
+		log.Fatalf("%T must implement AuthorizationCodePersistence to support the AuthorizationCode strategy", p)
+	}
+
+	return cp
+}
+
+// AuthorizationCodeResponseType implements the AuthorizationResponseType to allow for OAuth2's
+// code response type.
+type AuthorizationCodeResponseType struct {
+	SaverAuthorizationCode
+	lifetime                 time.Duration
+	forbidPlainCodeChallenge bool
+}
+
+// ValidateRequest validates the PKCE parameters of the request, as defined by
+// https://tools.ietf.org/html/rfc7636#section-4.4
+//
+// PKCE is always required for public clients, since the code is their only proof of authorization.
+func (rt AuthorizationCodeResponseType) ValidateRequest(ar *UserAuthorizationRequest) error {
+	if ar.CodeChallenge == "" {
+		if ar.Client.RequirePKCE || ar.Client.Public() || ar.CodeChallengeMethod != "" {
+			return ErrInvalidRequest
+		}
+		return nil
+	}
+
+	if ar.CodeChallengeMethod == "" {
+		ar.CodeChallengeMethod = CodeChallengePlain
+	}
+
+	switch ar.CodeChallengeMethod {
+	case CodeChallengeS256:
+	case CodeChallengePlain:
+		if rt.forbidPlainCodeChallenge {
+			return ErrInvalidRequest
+		}
+	default:
+		return ErrInvalidRequest
+	}
+
+	if !validCodeVerifier(ar.CodeChallenge) {
+		return ErrInvalidRequest
+	}
+
+	return nil
+}
+
+// Confirm accepts every request approved by the user, as codes carry no further requirements.
+func (rt AuthorizationCodeResponseType) Confirm(_ *UserAuthorizationRequest, _ http.ResponseWriter) error {
+	return nil
+}
+
+// Authorize issues a new authorization code for the request approved by the user.
+func (rt AuthorizationCodeResponseType) Authorize(ar *UserAuthorizationRequest) (*UserAuthorization, error) {
+	ac, err := NewUserAuthorizationCode(ar, rt.lifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := rt.SaveAuthorizationCode(ac); err != nil {
+		return nil, ErrServerError
+	}
+
+	return &UserAuthorization{UserAuthorizationRequest: *ar, Code: ac.Code}, nil
+}
+
+// AuthorizationCodeGrantType implements the TokenGrantType to allow for OAuth2's
+// authorization_code grant type.
+type AuthorizationCodeGrantType struct {
+	ConsumerAuthorizationCode
+}
+
+// IssueToken exchanges an authorization code previously issued to the requesting client for a new
+// token, as defined by the authorization code grant type.
+func (g AuthorizationCodeGrantType) IssueToken(c *Client, params url.Values) (*AccessToken, error) {
+	code := params.Get("code")
+	if code == "" {
+		return nil, ErrInvalidRequest
+	}
+
+	ac, err := g.ConsumeAuthorizationCode(code)
+	if err != nil {
+		return nil, ErrServerError
+	}
+	if ac == nil || ac.Expired() {
+		return nil, ErrInvalidGrant
+	}
+
+	if !uuid.Equal(ac.Client.ID, c.ID) {
+		return nil, ErrInvalidGrant
+	}
+
+	// The redirect_uri is only required if it was included in the authorization request, in which
+	// case their values must be identical.
+	if ac.RedirectURI != params.Get("redirect_uri") {
+		return nil, ErrInvalidGrant
+	}
+
+	// Codes issued with a code challenge can only be exchanged with the matching code verifier,
+	// and a code verifier is never accepted for codes issued without one.
+	verifier := params.Get("code_verifier")
+	if ac.CodeChallenge == "" {
+		if verifier != "" || c.Public() {
+			return nil, ErrInvalidGrant
+		}
+	} else if !VerifyCodeChallenge(ac.CodeChallenge, ac.CodeChallengeMethod, verifier) {
+		return nil, ErrInvalidGrant
+	}
+
+	at, err := NewAccessToken(c, ac.User, ac.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	at.Nonce = ac.Nonce
+	at.AuthTime = ac.AuthTime
+
+	return at, nil
+}
+
+// AllowsPublicClients allows public clients to exchange codes, which are always bound to a PKCE
+// code challenge for them.
+func (g AuthorizationCodeGrantType) AllowsPublicClients() bool {
+	return true
+}
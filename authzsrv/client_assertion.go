@@ -0,0 +1,211 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gostack/oauth22/jose"
+)
+
+// ClientAssertionTypeJWTBearer is the client_assertion_type of JWT client assertions, as defined by
+// https://tools.ietf.org/html/rfc7523#section-2.2
+const ClientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// assertionLeeway is the clock skew tolerated when validating the time based claims of assertions.
+const assertionLeeway = 30 * time.Second
+
+// jwksClient is the HTTP client used to fetch the JWKS registered by clients.
+var jwksClient = &http.Client{Timeout: 5 * time.Second}
+
+// clientAssertionAuthenticator authenticates clients using a signed JWT assertion, either signed
+// with a private key (private_key_jwt) or with a shared secret (client_secret_jwt), as defined by
+// https://tools.ietf.org/html/rfc7523#section-3 and
+// https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+type clientAssertionAuthenticator struct {
+	srv    *Server
+	method string
+}
+
+func (ca clientAssertionAuthenticator) Method() string {
+	return ca.method
+}
+
+// Detect tells both methods apart by the algorithm the assertion is signed with, so malformed
+// assertions aren't detected by either.
+func (ca clientAssertionAuthenticator) Detect(req *http.Request) bool {
+	if req.PostFormValue("client_assertion_type") != ClientAssertionTypeJWTBearer {
+		return false
+	}
+
+	t, err := jose.Parse(req.PostFormValue("client_assertion"))
+	if err != nil {
+		return false
+	}
+
+	return (t.Header.Algorithm == jose.HS256) == (ca.method == AuthMethodClientSecretJWT)
+}
+
+func (ca clientAssertionAuthenticator) AuthenticateClient(req *http.Request) (*Client, error) {
+	s := ca.srv
+
+	t, err := jose.Parse(req.PostFormValue("client_assertion"))
+	if err != nil {
+		return nil, ErrInvalidClient
+	}
+
+	var claims jose.Claims
+	if err := t.Claims(&claims); err != nil {
+		return nil, ErrInvalidClient
+	}
+
+	// The client identifies itself as both the issuer and subject of the assertion.
+	if claims.Issuer != claims.Subject {
+		return nil, ErrInvalidClient
+	}
+	if id := req.PostFormValue("client_id"); id != "" && id != claims.Subject {
+		return nil, ErrInvalidClient
+	}
+
+	c, err := s.loadClient(claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.verifyClientAssertionSignature(c, t); err != nil {
+		return nil, err
+	}
+
+	if err := s.validateAssertionClaims(req, claims); err != nil {
+		if err == ErrServerError {
+			return nil, err
+		}
+		return nil, ErrInvalidClient
+	}
+
+	return c, nil
+}
+
+// verifyClientAssertionSignature verifies the assertion was signed by the client, using either it's
+// JWT secret or one of it's registered public keys.
+func (s *Server) verifyClientAssertionSignature(c *Client, t *jose.Token) error {
+	if t.Header.Algorithm == jose.HS256 {
+		if len(c.JWTSecret) == 0 || t.Verify([]byte(c.JWTSecret)) != nil {
+			return ErrInvalidClient
+		}
+		return nil
+	}
+
+	if verifyAssertionSignature(t, c.JWKS, c.JWKSURI) != nil {
+		return ErrInvalidClient
+	}
+
+	return nil
+}
+
+// verifyAssertionSignature verifies the assertion was signed by one of the keys in the key set, or
+// the one published at the URI when the key set is empty.
+func verifyAssertionSignature(t *jose.Token, jwks jose.JSONWebKeySet, jwksURI string) error {
+	if len(jwks.Keys) == 0 && jwksURI != "" {
+		var err error
+		if jwks, err = fetchJWKS(jwksURI); err != nil {
+			return err
+		}
+	}
+
+	key := jwks.Key(t.Header.KeyID)
+	if key == nil && t.Header.KeyID == "" && len(jwks.Keys) == 1 {
+		key = &jwks.Keys[0]
+	}
+	if key == nil {
+		return jose.ErrInvalidSignature
+	}
+
+	return t.Verify(key.Key)
+}
+
+// validateAssertionClaims validates the claims of an assertion addressed to the server, as done by
+// validateAssertion. The assertion can be addressed to the issuer, the token endpoint or the
+// endpoint it was sent to.
+//
+// The audience is only known when an issuer was configured with Server.SetIssuer, since the one
+// derived from the request is controlled by the client, so assertions are rejected otherwise.
+func (s *Server) validateAssertionClaims(req *http.Request, claims jose.Claims) error {
+	if s.issuer == "" {
+		return jose.ErrInvalidAudience
+	}
+
+	consumer, _ := s.persistence.(ConsumerAssertionID)
+
+	return validateAssertion(claims, []string{s.issuer, s.issuer + TokenEndpointPath, s.issuer + req.URL.Path}, consumer)
+}
+
+// validateAssertion validates the audience, time based claims and the jti of an assertion, as
+// defined by https://tools.ietf.org/html/rfc7523#section-3, recording the jti so the assertion can't
+// be replayed. Replayed assertions return ErrInvalidGrant, while failing to record the jti returns
+// ErrServerError.
+func validateAssertion(claims jose.Claims, audiences []string, consumer ConsumerAssertionID) error {
+	addressed := false
+	for _, aud := range audiences {
+		addressed = addressed || claims.Audience.Contains(aud)
+	}
+	if !addressed {
+		return jose.ErrInvalidAudience
+	}
+
+	if err := claims.Validate(time.Now(), assertionLeeway); err != nil {
+		return err
+	}
+
+	if claims.ID == "" {
+		return ErrInvalidRequest
+	}
+
+	if consumer == nil {
+		return ErrServerError
+	}
+
+	fresh, err := consumer.ConsumeAssertionID(claims.Issuer, claims.ID, time.Unix(claims.ExpiresAt, 0).Add(assertionLeeway))
+	if err != nil {
+		return ErrServerError
+	}
+	if !fresh {
+		return ErrInvalidGrant
+	}
+
+	return nil
+}
+
+// fetchJWKS retrieves the key set published at the provided URI.
+func fetchJWKS(uri string) (jose.JSONWebKeySet, error) {
+	var jwks jose.JSONWebKeySet
+
+	resp, err := jwksClient.Get(uri)
+	if err != nil {
+		return jwks, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return jwks, ErrServerError
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	return jwks, err
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Client authentication methods supported by the Server, as registered in
+// https://www.iana.org/assignments/oauth-parameters
+const (
+	AuthMethodClientSecretBasic       = "client_secret_basic"
+	AuthMethodClientSecretPost        = "client_secret_post"
+	AuthMethodClientSecretJWT         = "client_secret_jwt"
+	AuthMethodPrivateKeyJWT           = "private_key_jwt"
+	AuthMethodTLSClientAuth           = "tls_client_auth"
+	AuthMethodSelfSignedTLSClientAuth = "self_signed_tls_client_auth"
+	AuthMethodNone                    = "none"
+	DefaultTokenEndpointAuthMethod    = AuthMethodClientSecretBasic
+)
+
+// ClientAuthenticator is the interface for the methods clients authenticate with at the token,
+// introspection and revocation endpoints.
+type ClientAuthenticator interface {
+	// Method returns the name of the authentication method, matched against the
+	// TokenEndpointAuthMethod of the client.
+	Method() string
+
+	// Detect returns whether the request attempts to authenticate using this method, without
+	// verifying the credentials.
+	Detect(req *http.Request) bool
+
+	// AuthenticateClient verifies the credentials included in the request, returning the client
+	// they belong to.
+	AuthenticateClient(req *http.Request) (*Client, error)
+}
+
+// RegisterClientAuthenticator adds a client authentication method to the server, replacing any
+// previously registered with the same name. The methods defined by the OAuth2 specifications are
+// registered by NewServer.
+func (s *Server) RegisterClientAuthenticator(ca ClientAuthenticator) {
+	s.clientAuthenticators[ca.Method()] = ca
+}
+
+// registerDefaultClientAuthenticators registers the client authentication methods implemented by
+// the package.
+func (s *Server) registerDefaultClientAuthenticators() {
+	s.RegisterClientAuthenticator(clientSecretBasicAuthenticator{s})
+	s.RegisterClientAuthenticator(clientSecretPostAuthenticator{s})
+	s.RegisterClientAuthenticator(clientAssertionAuthenticator{s, AuthMethodClientSecretJWT})
+	s.RegisterClientAuthenticator(clientAssertionAuthenticator{s, AuthMethodPrivateKeyJWT})
+	s.RegisterClientAuthenticator(clientCertificateAuthenticator{s, AuthMethodTLSClientAuth})
+	s.RegisterClientAuthenticator(clientCertificateAuthenticator{s, AuthMethodSelfSignedTLSClientAuth})
+	s.RegisterClientAuthenticator(publicClientAuthenticator{s})
+}
+
+// authenticateClientRequest authenticates the client using the only method detected in the
+// request, which must be the one the client was registered with.
+func (s *Server) authenticateClientRequest(req *http.Request) (*Client, error) {
+	var ca ClientAuthenticator
+
+	for _, a := range s.clientAuthenticators {
+		if !a.Detect(req) {
+			continue
+		}
+
+		// Clients must not use more than one authentication method in each request, as defined by
+		// https://tools.ietf.org/html/rfc6749#section-2.3
+		if ca != nil {
+			return nil, ErrInvalidRequest
+		}
+		ca = a
+	}
+
+	if ca == nil {
+		return nil, ErrInvalidClient
+	}
+
+	c, err := ca.AuthenticateClient(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.AuthMethod() != ca.Method() {
+		return nil, ErrInvalidClient
+	}
+
+	return c, nil
+}
+
+// clientSecretBasicAuthenticator authenticates clients using their secret in the HTTP Basic
+// authentication scheme, as defined by https://tools.ietf.org/html/rfc6749#section-2.3.1
+type clientSecretBasicAuthenticator struct {
+	srv *Server
+}
+
+func (ca clientSecretBasicAuthenticator) Method() string {
+	return AuthMethodClientSecretBasic
+}
+
+func (ca clientSecretBasicAuthenticator) Detect(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Authorization"), "Basic ")
+}
+
+func (ca clientSecretBasicAuthenticator) AuthenticateClient(req *http.Request) (*Client, error) {
+	textID, textSecret, ok := req.BasicAuth()
+	if !ok {
+		return nil, ErrInvalidRequest
+	}
+
+	return ca.srv.authenticateClientSecret(textID, textSecret)
+}
+
+// clientSecretPostAuthenticator authenticates clients using their secret in the request body, as
+// defined by https://tools.ietf.org/html/rfc6749#section-2.3.1
+type clientSecretPostAuthenticator struct {
+	srv *Server
+}
+
+func (ca clientSecretPostAuthenticator) Method() string {
+	return AuthMethodClientSecretPost
+}
+
+func (ca clientSecretPostAuthenticator) Detect(req *http.Request) bool {
+	return req.PostFormValue("client_secret") != ""
+}
+
+func (ca clientSecretPostAuthenticator) AuthenticateClient(req *http.Request) (*Client, error) {
+	return ca.srv.authenticateClientSecret(req.PostFormValue("client_id"), req.PostFormValue("client_secret"))
+}
+
+// authenticateClientSecret verifies the secret against the ones registered for the client.
+func (s *Server) authenticateClientSecret(textID, textSecret string) (*Client, error) {
+	if textID == "" || textSecret == "" {
+		return nil, ErrInvalidClient
+	}
+
+	var secret Secret
+
+	if err := secret.UnmarshalText([]byte(textSecret)); err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	c, err := s.loadClient(textID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.VerifySecret(secret) {
+		return nil, ErrInvalidClient
+	}
+
+	return c, nil
+}
+
+// publicClientAuthenticator identifies public clients, which can't keep credentials confidential,
+// by their client_id alone, as defined by https://tools.ietf.org/html/rfc6749#section-2.1
+//
+// Since the client isn't actually authenticated, public clients are only allowed to use the grant
+// types implementing PublicClientGrantType.
+type publicClientAuthenticator struct {
+	srv *Server
+}
+
+func (ca publicClientAuthenticator) Method() string {
+	return AuthMethodNone
+}
+
+func (ca publicClientAuthenticator) Detect(req *http.Request) bool {
+	if req.PostFormValue("client_id") == "" || req.Header.Get("Authorization") != "" || peerCertificate(req) != nil {
+		return false
+	}
+
+	return req.PostFormValue("client_secret") == "" && req.PostFormValue("client_assertion") == ""
+}
+
+func (ca publicClientAuthenticator) AuthenticateClient(req *http.Request) (*Client, error) {
+	c, err := ca.srv.loadClient(req.PostFormValue("client_id"))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Confidential {
+		return nil, ErrInvalidClient
+	}
+
+	return c, nil
+}
@@ -44,6 +44,6 @@ type ClientCredentialsGrantType struct{}
 // IssueToken issues a new token for the requesting client as defined by the client credential grant
 // type.
 func (g ClientCredentialsGrantType) IssueToken(c *Client, params url.Values) (*AccessToken, error) {
-	scopes := strings.Split(params.Get("scope"), " ")
+	scopes := strings.Fields(params.Get("scope"))
 	return NewAccessToken(c, nil, scopes)
 }
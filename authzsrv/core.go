@@ -17,18 +17,36 @@ limitations under the License.
 package authzsrv
 
 import (
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/satori/go.uuid"
 
+	"github.com/gostack/oauth22/jose"
 	"github.com/gostack/oauth22/security"
 )
 
 // User is an type representing the current user in the system.
 type User struct {
-	Username string
-	Password []byte
+	Username     string
+	PasswordHash string
+}
+
+// SetPassword hashes the password using the preferred hasher, replacing the user's password hash.
+func (u *User) SetPassword(hs security.PasswordHashers, password string) error {
+	h, err := hs.Hash([]byte(password))
+	if err != nil {
+		return err
+	}
+
+	u.PasswordHash = h
+	return nil
 }
 
 // Secret is a seq of bytes that knows how to serialize itself
@@ -66,30 +84,233 @@ func (s *Secret) UnmarshalText(text []byte) error {
 // https://tools.ietf.org/html/rfc6749#section-2
 type Client struct {
 	ID           uuid.UUID
-	Secret       Secret
+	Secrets      []ClientSecret
 	Name         string
 	RedirectURI  string
 	Confidential bool
 	Internal     bool
+	RequirePKCE  bool
+
+	// GrantTypes and ResponseTypes restrict the grant types and response types the client is
+	// allowed to use to the ones listed. Clients without any listed are allowed to use all the ones
+	// registered in the Server.
+	GrantTypes    []string
+	ResponseTypes []string
+
+	// Scopes restricts the scopes granted to the client to the ones listed. Clients without any
+	// listed can be granted all the scopes known by the Server.
+	Scopes []string
+
+	// TokenEndpointAuthMethod is the only method the client is allowed to authenticate with. When
+	// empty, it defaults to AuthMethodNone for public clients without secrets, and to
+	// DefaultTokenEndpointAuthMethod otherwise.
+	TokenEndpointAuthMethod string
+
+	// JWKS and JWKSURI register the public keys the client signs it's assertions with when
+	// authenticating with private_key_jwt. JWKSURI is only used when JWKS is empty.
+	JWKS    jose.JSONWebKeySet
+	JWKSURI string
+
+	// JWTSecret is the shared secret the client signs it's assertions with when authenticating with
+	// client_secret_jwt. Since the server needs it to verify signatures, it can't be hashed, and
+	// should only be set for clients that can't use private_key_jwt.
+	JWTSecret Secret
+
+	// TLSClientAuthSubjectDN and the TLSClientAuthSAN fields register the certificate the client
+	// authenticates with when using tls_client_auth. The certificate must be valid for the CAs
+	// trusted by the server's TLS configuration, and match the only field set. Clients using
+	// self_signed_tls_client_auth register their certificates in the x5c of their JWKS instead.
+	TLSClientAuthSubjectDN string
+	TLSClientAuthSANDNS    string
+	TLSClientAuthSANURI    string
+	TLSClientAuthSANIP     string
+	TLSClientAuthSANEmail  string
+
+	// TLSClientCertificateBoundAccessTokens binds the access tokens issued to the client to the
+	// certificate used in the mutual TLS connection with the token endpoint.
+	TLSClientCertificateBoundAccessTokens bool
 }
 
-// GenerateCredentials securely generate and initialize the Client's ID and Secret.
-func (c *Client) GenerateCredentials() error {
-	var err error
+// AuthMethod returns the method the client authenticates with.
+func (c Client) AuthMethod() string {
+	switch {
+	case c.TokenEndpointAuthMethod != "":
+		return c.TokenEndpointAuthMethod
+	case !c.Confidential && len(c.Secrets) == 0:
+		return AuthMethodNone
+	default:
+		return DefaultTokenEndpointAuthMethod
+	}
+}
+
+// AllowsGrantType returns whether the client is allowed to use the grant type.
+func (c Client) AllowsGrantType(grantType string) bool {
+	return len(c.GrantTypes) == 0 || contains(c.GrantTypes, grantType)
+}
+
+// AllowsResponseType returns whether the client is allowed to use the response type.
+func (c Client) AllowsResponseType(responseType string) bool {
+	return len(c.ResponseTypes) == 0 || contains(c.ResponseTypes, responseType)
+}
+
+// AllowsScope returns whether the client can be granted the scope.
+func (c Client) AllowsScope(scope string) bool {
+	return len(c.Scopes) == 0 || contains(c.Scopes, scope)
+}
+
+// Public returns whether the client is a public client, identified by it's client_id alone.
+func (c Client) Public() bool {
+	return c.AuthMethod() == AuthMethodNone
+}
+
+// GenerateCredentials securely generate and initialize the Client's ID and Secret. Since only a hash
+// of the secret is kept, the returned plaintext secret must be handed to the client right away, as
+// there's no way to recover it later.
+func (c *Client) GenerateCredentials() (Secret, error) {
+	secret, cs, err := generateClientSecret()
+	if err != nil {
+		return nil, err
+	}
 
 	c.ID = uuid.NewV4()
-	c.Secret, err = security.Random(128)
+	c.Secrets = []ClientSecret{cs}
+	return secret, nil
+}
+
+// VerifySecret returns whether the plaintext secret matches any of the Client's secrets that didn't
+// expire yet.
+func (c Client) VerifySecret(secret Secret) bool {
+	valid := false
+	for _, cs := range c.Secrets {
+		// Every secret is verified, so the timing doesn't reveal which one matched.
+		if !cs.Expired() && cs.Verify(secret) {
+			valid = true
+		}
+	}
+
+	return valid
+}
+
+// StartSecretRotation generates a new secret for the Client, while it's current secrets remain valid
+// for the provided overlap, giving time for every instance of the client to be updated. As with
+// GenerateCredentials, the returned plaintext secret must be handed to the client right away.
+func (c *Client) StartSecretRotation(overlap time.Duration) (Secret, error) {
+	secret, cs, err := generateClientSecret()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	expiresAt := time.Now().Add(overlap)
+	secrets := []ClientSecret{}
+	for _, old := range c.Secrets {
+		if old.Expired() {
+			continue
+		}
+		if old.ExpiresAt.IsZero() || old.ExpiresAt.After(expiresAt) {
+			old.ExpiresAt = expiresAt
+		}
+		secrets = append(secrets, old)
+	}
+
+	c.Secrets = append(secrets, cs)
+	return secret, nil
+}
+
+// FinishSecretRotation revokes every secret but the most recent one, once every instance of the
+// client has been updated.
+func (c *Client) FinishSecretRotation() {
+	if len(c.Secrets) > 1 {
+		c.Secrets = c.Secrets[len(c.Secrets)-1:]
+	}
+}
+
+// generateClientSecret generates a new plaintext secret and it's ClientSecret.
+func generateClientSecret() (Secret, ClientSecret, error) {
+	secret, err := security.Random(128)
+	if err != nil {
+		return nil, ClientSecret{}, err
+	}
+
+	cs, err := NewClientSecret(secret)
+	if err != nil {
+		return nil, ClientSecret{}, err
+	}
+
+	return secret, cs, nil
+}
+
+// ClientSecretPrefixLength is the length of the plaintext prefix kept along with a secret's hash.
+const ClientSecretPrefixLength = 6
+
+// ErrSecretTooShort is returned by NewClientSecret for secrets whose prefix would reveal all of it.
+var ErrSecretTooShort = errors.New("secret is too short")
+
+// ClientSecret is the stored representation of a client secret. Only a salted hash of the secret is
+// kept, along with a short prefix of it's textual representation that can be displayed to help
+// identifying which secret a client is using. Secrets without an expiration time never expire.
+type ClientSecret struct {
+	Hash      string
+	Prefix    string
+	ExpiresAt time.Time
+}
+
+// NewClientSecret hashes the plaintext secret into a ClientSecret. Secrets must be longer than
+// their prefix, returning ErrSecretTooShort otherwise.
+func NewClientSecret(secret Secret) (ClientSecret, error) {
+	text := secret.String()
+	if len(text) <= ClientSecretPrefixLength {
+		return ClientSecret{}, ErrSecretTooShort
+	}
+
+	h, err := security.HashSecret(secret)
+	if err != nil {
+		return ClientSecret{}, err
+	}
+
+	return ClientSecret{Hash: h, Prefix: text[:ClientSecretPrefixLength]}, nil
+}
+
+// Verify returns whether the plaintext secret matches the ClientSecret.
+func (cs ClientSecret) Verify(secret Secret) bool {
+	return security.VerifySecret(cs.Hash, secret)
+}
+
+// Expired returns whether the ClientSecret can no longer be used.
+func (cs ClientSecret) Expired() bool {
+	return !cs.ExpiresAt.IsZero() && time.Now().After(cs.ExpiresAt)
 }
 
 // UserAuthorizationRequest represents a request for a UserAuthorization
 type UserAuthorizationRequest struct {
-	Client Client
-	Scope  []string
+	Client       Client
+	User         *User
+	Scope        []string
+	ResponseType string
+	RedirectURI  string
+	State        string
+
+	// CodeChallenge and CodeChallengeMethod are provided by clients using PKCE, as defined by
+	// https://tools.ietf.org/html/rfc7636#section-4.3
+	CodeChallenge       string
+	CodeChallengeMethod string
+
+	// Nonce is provided by OpenID Connect clients to bind the ID token to their session, as defined
+	// by https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+	Nonce string
+
+	// AuthTime is the time the user authenticated, which the UserAuthorizationHandler may set when
+	// the user authenticated before the request. It defaults to the time the request was approved.
+	AuthTime time.Time
+}
+
+// redirectURI returns the URI the user-agent must be redirected to once the request is decided,
+// which is the one provided by the client or, in its absence, the one registered for it.
+func (ar UserAuthorizationRequest) redirectURI() string {
+	if ar.RedirectURI != "" {
+		return ar.RedirectURI
+	}
+
+	return ar.Client.RedirectURI
 }
 
 // UserAuthorization represents an explicit authorization given by the user to a specific client application.
@@ -99,7 +320,80 @@ type UserAuthorizationRequest struct {
 // https://tools.ietf.org/html/rfc6749#section-4.2
 type UserAuthorization struct {
 	UserAuthorizationRequest
+	Code         string
 	RefreshToken []byte
+
+	// AccessToken is the token issued directly by the token response type.
+	AccessToken *AccessToken
+}
+
+// responseParams returns the parameters sent back to the client through the redirection URI.
+func (ua UserAuthorization) responseParams() url.Values {
+	params := url.Values{}
+	if ua.Code != "" {
+		params.Set("code", ua.Code)
+	}
+	if at := ua.AccessToken; at != nil {
+		params.Set("access_token", at.Token)
+		params.Set("token_type", "Bearer")
+		params.Set("expires_in", strconv.FormatInt(int64(at.ExpiresIn/time.Second), 10))
+		if len(at.Scopes) > 0 {
+			params.Set("scope", strings.Join(at.Scopes, " "))
+		}
+	}
+	if ua.State != "" {
+		params.Set("state", ua.State)
+	}
+
+	return params
+}
+
+// UserAuthorizationCode represents a short-lived, single use code issued to the client once the user
+// authorized it, to be exchanged for an AccessToken at the token endpoint.
+//
+// Related RFC topics:
+// https://tools.ietf.org/html/rfc6749#section-4.1.2
+// https://tools.ietf.org/html/rfc6749#section-10.5
+type UserAuthorizationCode struct {
+	Code                string
+	Client              *Client
+	User                *User
+	Scopes              []string
+	RedirectURI         string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+	AuthTime            time.Time
+	ExpiresAt           time.Time
+}
+
+// NewUserAuthorizationCode creates a new UserAuthorizationCode for the provided request, valid for the
+// provided duration.
+func NewUserAuthorizationCode(ar *UserAuthorizationRequest, lifetime time.Duration) (*UserAuthorizationCode, error) {
+	code, err := security.Random(32)
+	if err != nil {
+		return nil, err
+	}
+
+	ac := UserAuthorizationCode{
+		Code:                Secret(code).String(),
+		Client:              &ar.Client,
+		User:                ar.User,
+		Scopes:              ar.Scope,
+		RedirectURI:         ar.RedirectURI,
+		CodeChallenge:       ar.CodeChallenge,
+		CodeChallengeMethod: ar.CodeChallengeMethod,
+		Nonce:               ar.Nonce,
+		AuthTime:            ar.AuthTime,
+		ExpiresAt:           time.Now().Add(lifetime),
+	}
+
+	return &ac, nil
+}
+
+// Expired returns whether the UserAuthorizationCode can no longer be exchanged.
+func (ac UserAuthorizationCode) Expired() bool {
+	return time.Now().After(ac.ExpiresAt)
 }
 
 // AccessToken represents an OAuth2 Access Token issued for an application.
@@ -108,12 +402,35 @@ type UserAuthorization struct {
 // https://tools.ietf.org/html/rfc6749#section-1.1
 // https://tools.ietf.org/html/rfc6749#section-1.4
 type AccessToken struct {
-	Client       *Client       `json:"-"`
-	User         *User         `json:"-"`
-	Scopes       []string      `json:"-"`
-	Token        []byte        `json:"access_token"`
-	ExpiresIn    time.Duration `json:"expires_in"`
-	RefreshToken string        `json:"refresh_token,omitempty"`
+	Client       *Client
+	User         *User
+	Scopes       []string
+	Token        string
+	IssuedAt     time.Time
+	ExpiresIn    time.Duration
+	RefreshToken string
+
+	// FamilyID identifies the refresh token family the token was issued with, if any, allowing it
+	// to be revoked along with it's refresh tokens.
+	FamilyID uuid.UUID
+
+	// CertificateThumbprint is the x5t#S256 thumbprint of the client certificate the token is bound
+	// to, if any, as defined by https://tools.ietf.org/html/rfc8705#section-3.1
+	CertificateThumbprint string
+
+	// Audience restricts the resource servers the token is addressed to, when not empty.
+	Audience []string
+
+	// Actor identifies the party the token was delegated to, if any, while IssuedTokenType is only
+	// reported for tokens issued by token exchange.
+	Actor           *Actor
+	IssuedTokenType string
+
+	// Nonce and AuthTime are carried over from the authorization request the token was issued for,
+	// while IDToken is the OpenID Connect ID token issued along with it, if any.
+	Nonce    string
+	AuthTime time.Time
+	IDToken  string
 }
 
 // NewAccessToken creates a new AccessToken with the provided information and sensible defaults.
@@ -126,10 +443,158 @@ func NewAccessToken(c *Client, u *User, scopes []string) (*AccessToken, error) {
 	at := AccessToken{
 		Client:    c,
 		User:      u,
-		Token:     t,
+		Token:     Secret(t).String(),
 		Scopes:    scopes,
+		IssuedAt:  time.Now(),
 		ExpiresIn: (24 * time.Hour) * 15,
 	}
 
 	return &at, nil
 }
+
+// VerifyCertificate returns whether the AccessToken can be used by a client presenting the provided
+// certificate, which is always the case for tokens that are not bound to a certificate.
+func (at AccessToken) VerifyCertificate(cert *x509.Certificate) bool {
+	if at.CertificateThumbprint == "" {
+		return true
+	}
+
+	return cert != nil && security.Compare([]byte(at.CertificateThumbprint), []byte(CertificateThumbprint(cert)))
+}
+
+// Subject returns the subject of the token, which is the user it was issued on behalf of, or the
+// client itself when issued on it's own behalf.
+func (at AccessToken) Subject() string {
+	if at.User != nil {
+		return at.User.Username
+	}
+	return at.Client.ID.String()
+}
+
+// ExpiresAt returns the time after which the AccessToken is no longer valid.
+func (at AccessToken) ExpiresAt() time.Time {
+	return at.IssuedAt.Add(at.ExpiresIn)
+}
+
+// Expired returns whether the AccessToken is no longer valid.
+func (at AccessToken) Expired() bool {
+	return time.Now().After(at.ExpiresAt())
+}
+
+// MarshalJSON serializes the AccessToken as the token endpoint response, as defined by
+// https://tools.ietf.org/html/rfc6749#section-5.1
+func (at AccessToken) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		AccessToken     string `json:"access_token"`
+		IssuedTokenType string `json:"issued_token_type,omitempty"`
+		TokenType       string `json:"token_type"`
+		ExpiresIn       int64  `json:"expires_in"`
+		RefreshToken    string `json:"refresh_token,omitempty"`
+		Scope           string `json:"scope,omitempty"`
+		IDToken         string `json:"id_token,omitempty"`
+	}{
+		AccessToken:     at.Token,
+		IssuedTokenType: at.IssuedTokenType,
+		TokenType:       "Bearer",
+		ExpiresIn:       int64(at.ExpiresIn / time.Second),
+		RefreshToken:    at.RefreshToken,
+		Scope:           strings.Join(at.Scopes, " "),
+		IDToken:         at.IDToken,
+	})
+}
+
+// UserRefreshToken represents a refresh token issued along with an AccessToken, allowing the client
+// to obtain new access tokens without the user's intervention. Every time a refresh token is used it
+// is replaced by a new one from the same family, so the reuse of an old token can be detected.
+//
+// Related RFC topics:
+// https://tools.ietf.org/html/rfc6749#section-1.5
+// https://tools.ietf.org/html/rfc6749#section-10.4
+type UserRefreshToken struct {
+	Token     string
+	FamilyID  uuid.UUID
+	Client    *Client
+	User      *User
+	Scopes    []string
+	ExpiresAt time.Time
+	Used      bool
+	Revoked   bool
+}
+
+// NewUserRefreshToken creates a new UserRefreshToken for the provided AccessToken, as part of the
+// given token family and valid for the provided duration.
+func NewUserRefreshToken(at *AccessToken, familyID uuid.UUID, lifetime time.Duration) (*UserRefreshToken, error) {
+	t, err := security.Random(32)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := UserRefreshToken{
+		Token:     Secret(t).String(),
+		FamilyID:  familyID,
+		Client:    at.Client,
+		User:      at.User,
+		Scopes:    at.Scopes,
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+
+	return &rt, nil
+}
+
+// Expired returns whether the UserRefreshToken can no longer be used.
+func (rt UserRefreshToken) Expired() bool {
+	return time.Now().After(rt.ExpiresAt)
+}
+
+// UserDeviceCode is the authorization request of a device, pending until the user enters the user
+// code in the verification page and approves or denies it, as defined by
+// https://tools.ietf.org/html/rfc8628#section-3.2
+type UserDeviceCode struct {
+	DeviceCode string
+	UserCode   string
+	Client     *Client
+	Scopes     []string
+
+	// User is set once the user approved the request, while Denied is set once denied.
+	User   *User
+	Denied bool
+
+	// Interval is the minimum duration the client must wait between polling requests.
+	Interval     time.Duration
+	ExpiresAt    time.Time
+	LastPolledAt time.Time
+}
+
+// NewUserDeviceCode generates a new UserDeviceCode for the client.
+func NewUserDeviceCode(c *Client, scopes []string, lifetime, interval time.Duration) (*UserDeviceCode, error) {
+	t, err := security.Random(32)
+	if err != nil {
+		return nil, err
+	}
+
+	userCode, err := generateUserCode()
+	if err != nil {
+		return nil, err
+	}
+
+	dc := UserDeviceCode{
+		DeviceCode: Secret(t).String(),
+		UserCode:   userCode,
+		Client:     c,
+		Scopes:     scopes,
+		Interval:   interval,
+		ExpiresAt:  time.Now().Add(lifetime),
+	}
+
+	return &dc, nil
+}
+
+// Expired returns whether the UserDeviceCode can no longer be approved or exchanged.
+func (dc UserDeviceCode) Expired() bool {
+	return time.Now().After(dc.ExpiresAt)
+}
+
+// Pending returns whether the user has yet to approve or deny the request.
+func (dc UserDeviceCode) Pending() bool {
+	return dc.User == nil && !dc.Denied
+}
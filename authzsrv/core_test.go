@@ -19,7 +19,9 @@ package authzsrv
 import (
 	"bytes"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gostack/oauth22/security"
 )
@@ -50,7 +52,8 @@ func TestSecretMarshaling(t *testing.T) {
 func TestClientCredentials(t *testing.T) {
 	c := Client{Name: "Test Client", RedirectURI: "https://example.test/oauth2/callback"}
 
-	if err := c.GenerateCredentials(); err != nil {
+	secret, err := c.GenerateCredentials()
+	if err != nil {
 		t.Error(err)
 	}
 
@@ -58,21 +61,77 @@ func TestClientCredentials(t *testing.T) {
 		t.Fatal("ID not properly initialized")
 	}
 
-	if reflect.DeepEqual(c.Secret, []byte("")) {
+	if len(secret) == 0 || len(c.Secrets) != 1 || c.Secrets[0].Hash == "" {
 		t.Fatal("Secret not properly initialized")
 	}
+
+	if !strings.HasPrefix(secret.String(), c.Secrets[0].Prefix) {
+		t.Fatalf("unexpected secret prefix %s", c.Secrets[0].Prefix)
+	}
+
+	if !c.VerifySecret(secret) || c.VerifySecret(secret[1:]) {
+		t.Fatal("Secret not properly verified")
+	}
+}
+
+func TestNewClientSecret(t *testing.T) {
+	for _, secret := range []Secret{nil, Secret("abc"), Secret("abcd")} {
+		if _, err := NewClientSecret(secret); err != ErrSecretTooShort {
+			t.Errorf("unexpected error %v for secret %q", err, secret)
+		}
+	}
+
+	cs, err := NewClientSecret(Secret("abcde"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Prefix != Secret("abcde").String()[:ClientSecretPrefixLength] || !cs.Verify(Secret("abcde")) {
+		t.Fatalf("unexpected client secret %#v", cs)
+	}
+}
+
+func TestClientSecretRotation(t *testing.T) {
+	c := Client{Name: "Test Client"}
+
+	old, err := c.GenerateCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := c.StartSecretRotation(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.VerifySecret(old) || !c.VerifySecret(current) {
+		t.Fatal("both secrets should be valid during the rotation")
+	}
+
+	c.FinishSecretRotation()
+	if c.VerifySecret(old) || !c.VerifySecret(current) {
+		t.Fatal("only the new secret should be valid once the rotation is finished")
+	}
+
+	next, err := c.StartSecretRotation(-time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.VerifySecret(current) || !c.VerifySecret(next) {
+		t.Fatal("secrets should not be valid after the overlap")
+	}
 }
 
 func TestNewAccessToken(t *testing.T) {
 	c := Client{Name: "Test Client", RedirectURI: "https://example.test/oauth2/callback"}
-	u := User{Username: "foobario", Password: []byte("password")}
+	u := User{Username: "foobario"}
 
 	at, err := NewAccessToken(&c, &u, []string{"basic"})
 	if err != nil {
 		t.Error(err)
 	}
 
-	if reflect.DeepEqual(at.Token, []byte("")) {
+	if at.Token == "" {
 		t.Fatal("token not properly generated")
 	}
 
@@ -80,3 +139,75 @@ func TestNewAccessToken(t *testing.T) {
 		t.Fatal("access token scopes not properly initialized")
 	}
 }
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// Example from https://tools.ietf.org/html/rfc7636#appendix-B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+	table := []struct {
+		Challenge, Method, Verifier string
+		Result                      bool
+	}{
+		{"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", CodeChallengeS256, verifier, true},
+		{"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", CodeChallengePlain, verifier, false},
+		{verifier, CodeChallengePlain, verifier, true},
+		{verifier, CodeChallengeS256, verifier, false},
+		{"short", CodeChallengePlain, "short", false},
+		{verifier, "unknown", verifier, false},
+	}
+
+	for i, e := range table {
+		if VerifyCodeChallenge(e.Challenge, e.Method, e.Verifier) != e.Result {
+			t.Errorf("entry #%d: expected verification with method %s to be %t", i, e.Method, e.Result)
+		}
+	}
+}
+
+func TestCompleteDeviceCode(t *testing.T) {
+	p := NewInMemoryPersistence()
+
+	dc, err := NewUserDeviceCode(&Client{}, nil, time.Minute, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SaveDeviceCode(dc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ConsumeDeviceCode(dc.DeviceCode); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := p.CompleteDeviceCode(dc.DeviceCode, &User{Username: "john"}, false); err != nil || !ok {
+		t.Fatalf("pending device code not completed (%v)", err)
+	}
+	if ok, _ := p.CompleteDeviceCode(dc.DeviceCode, nil, true); ok {
+		t.Fatal("approved device code completed again")
+	}
+
+	completed, err := p.ConsumeDeviceCode(dc.DeviceCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completed.User == nil || completed.Denied || completed.LastPolledAt.IsZero() {
+		t.Fatalf("unexpected completed device code %#v", completed)
+	}
+}
+
+func TestUserCode(t *testing.T) {
+	code, err := generateUserCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(code) != userCodeLength || normalizeUserCode(code) != code {
+		t.Fatalf("invalid user code %s", code)
+	}
+
+	formatted := formatUserCode(code)
+	if formatted[4] != '-' {
+		t.Fatalf("unexpected formatted user code %s", formatted)
+	}
+	if normalizeUserCode(" "+strings.ToLower(formatted)) != code {
+		t.Fatalf("user code %s not normalized back to %s", formatted, code)
+	}
+}
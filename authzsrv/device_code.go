@@ -0,0 +1,319 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gostack/oauth22/security"
+	"github.com/gostack/option"
+	"github.com/satori/go.uuid"
+)
+
+// GrantTypeDeviceCode is the grant type of the device code grant, as defined by
+// https://tools.ietf.org/html/rfc8628#section-3.4
+const GrantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Defaults used when none is configured in the DeviceCode strategy.
+const (
+	DefaultDeviceCodeLifetime = 10 * time.Minute
+	DefaultDeviceCodeInterval = 5 * time.Second
+)
+
+// userCodeCharset is the set of characters user codes are made of. It only contains consonants, so
+// that user codes are easy to type and never spell words, as recommended by
+// https://tools.ietf.org/html/rfc8628#section-6.1
+const userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+
+// userCodeLength is the number of characters in user codes, giving ~34 bits of entropy.
+const userCodeLength = 8
+
+// DeviceCode implements the OAuth2 Device Authorization Grant, for devices that lack a browser or
+// are input constrained, as described by https://tools.ietf.org/html/rfc8628
+//
+// Once registered, devices request a device code from the device authorization endpoint, and poll
+// the token endpoint with it while the user approves the request in the verification page, which
+// is rendered by the DeviceVerificationHandler configured in the Server.
+//
+// The Persistence provided to the Server must also implement DeviceCodePersistence.
+type DeviceCode struct {
+	// CodeLifetime is the duration for which the user can approve the request.
+	CodeLifetime time.Duration
+
+	// Interval is the minimum duration clients must wait between polling requests.
+	Interval time.Duration
+}
+
+// ResponseType simply registers a nil AuthorizationResponseType for DeviceCode
+func (s DeviceCode) ResponseType(_ Persistence) (option.String, AuthorizationResponseType) {
+	return option.NoneString(), nil
+}
+
+// GrantType registers the device code grant type for DeviceCode.
+func (s DeviceCode) GrantType(p Persistence) (option.String, TokenGrantType) {
+	dp, ok := p.(DeviceCodePersistence)
+	if !ok {
+		log.Fatalf("%T must implement DeviceCodePersistence to support the DeviceCode strategy", p)
+	}
+
+	gt := DeviceCodeGrantType{
+		DeviceCodePersistence: dp,
+		lifetime:              s.CodeLifetime,
+		interval:              s.Interval,
+	}
+
+	if gt.lifetime == 0 {
+		gt.lifetime = DefaultDeviceCodeLifetime
+	}
+	if gt.interval == 0 {
+		gt.interval = DefaultDeviceCodeInterval
+	}
+
+	return option.SomeString(GrantTypeDeviceCode), gt
+}
+
+// DeviceCodeGrantType implements the TokenGrantType to allow for OAuth2's device code grant type.
+type DeviceCodeGrantType struct {
+	DeviceCodePersistence
+	lifetime time.Duration
+	interval time.Duration
+}
+
+// AuthorizeDevice issues a new device code for the client, to be approved by the user.
+func (g DeviceCodeGrantType) AuthorizeDevice(c *Client, scopes []string) (*UserDeviceCode, error) {
+	dc, err := NewUserDeviceCode(c, scopes, g.lifetime, g.interval)
+	if err != nil {
+		return nil, ErrServerError
+	}
+
+	if err := g.SaveDeviceCode(dc); err != nil {
+		return nil, ErrServerError
+	}
+
+	return dc, nil
+}
+
+// IssueToken exchanges a device code approved by the user for a new token, reporting the state of
+// the authorization request while it's not approved, as defined by
+// https://tools.ietf.org/html/rfc8628#section-3.5
+func (g DeviceCodeGrantType) IssueToken(c *Client, params url.Values) (*AccessToken, error) {
+	code := params.Get("device_code")
+	if code == "" {
+		return nil, ErrInvalidRequest
+	}
+
+	dc, err := g.ConsumeDeviceCode(code)
+	if err != nil {
+		return nil, ErrServerError
+	}
+	if dc == nil || !uuid.Equal(dc.Client.ID, c.ID) {
+		return nil, ErrInvalidGrant
+	}
+
+	switch {
+	case dc.Expired():
+		return nil, ErrExpiredToken
+	case dc.Denied:
+		return nil, ErrDeviceAccessDenied
+	case dc.User == nil:
+		if !dc.LastPolledAt.IsZero() && time.Since(dc.LastPolledAt) < dc.Interval {
+			return nil, ErrSlowDown
+		}
+		return nil, ErrAuthorizationPending
+	}
+
+	return NewAccessToken(c, dc.User, dc.Scopes)
+}
+
+// AllowsPublicClients allows public clients to use device codes, since most devices can't keep
+// credentials confidential.
+func (g DeviceCodeGrantType) AllowsPublicClients() bool {
+	return true
+}
+
+// DeviceAuthorizationResponse is the response of the device authorization endpoint, as defined by
+// https://tools.ietf.org/html/rfc8628#section-3.2
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// DeviceVerificationHandler is the interface applications implement in order to render the
+// verification page, where the user enters the user code displayed by the device, authenticates and
+// decides on the device authorization request.
+//
+// VerifyUser is called with a nil UserDeviceCode when the request has no user code, or one that is
+// unknown or no longer pending, in which case it must write the response itself (e.g. rendering the
+// form to enter the user code). Otherwise, it works like UserAuthorizationHandler.AuthorizeUser.
+//
+// CompleteVerification is called once the user approved or denied the request, with ErrAccessDenied
+// in the later case, and must inform the user that it may return to the device. It's called with
+// ErrInvalidGrant instead when the request was no longer pending, e.g. if approved meanwhile in
+// another verification page.
+type DeviceVerificationHandler interface {
+	VerifyUser(w http.ResponseWriter, req *http.Request, dc *UserDeviceCode) (*User, error)
+	CompleteVerification(w http.ResponseWriter, req *http.Request, dc *UserDeviceCode, err error)
+}
+
+// deviceAuthorizationEndpointHandler issues device codes to clients, as defined by
+// https://tools.ietf.org/html/rfc8628#section-3.1
+func (s *Server) deviceAuthorizationEndpointHandler(w http.ResponseWriter, req *http.Request) {
+	gt, ok := s.grantTypes[GrantTypeDeviceCode].(DeviceCodeGrantType)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	c, err := s.authenticateClientRequest(req)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	if !c.AllowsGrantType(GrantTypeDeviceCode) {
+		respondError(w, ErrUnauthorizedClient)
+		return
+	}
+
+	scopes, err := s.grantScopes(c, strings.Fields(req.PostFormValue("scope")))
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	dc, err := gt.AuthorizeDevice(c, scopes)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	verificationURI := s.issuerFor(req) + DeviceVerificationEndpointPath
+	userCode := formatUserCode(dc.UserCode)
+
+	// The interval is advertised in whole seconds, rounding up so clients never poll too fast.
+	interval := dc.Interval + time.Second - 1
+
+	respondJSON(w, DeviceAuthorizationResponse{
+		DeviceCode:              dc.DeviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?" + url.Values{"user_code": []string{userCode}}.Encode(),
+		ExpiresIn:               int64(time.Until(dc.ExpiresAt) / time.Second),
+		Interval:                int64(interval / time.Second),
+	})
+}
+
+// deviceVerificationEndpointHandler handles the verification page, where the user approves or
+// denies the device authorization request matching the user code.
+func (s *Server) deviceVerificationEndpointHandler(w http.ResponseWriter, req *http.Request) {
+	gt, ok := s.grantTypes[GrantTypeDeviceCode].(DeviceCodeGrantType)
+	if !ok || s.deviceVerificationHandler == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		respondError(w, ErrInvalidRequest)
+		return
+	}
+
+	var dc *UserDeviceCode
+
+	if userCode := normalizeUserCode(req.Form.Get("user_code")); userCode != "" {
+		loaded, err := gt.LoadDeviceCodeFromUserCode(userCode)
+		if err != nil {
+			s.deviceVerificationHandler.CompleteVerification(w, req, nil, ErrServerError)
+			return
+		}
+		if loaded != nil && loaded.Pending() && !loaded.Expired() {
+			dc = loaded
+		}
+	}
+
+	u, err := s.deviceVerificationHandler.VerifyUser(w, req, dc)
+	if dc == nil || (u == nil && err == nil) {
+		return
+	}
+
+	switch {
+	case err == ErrAccessDenied:
+		dc.Denied = true
+	case err != nil:
+		s.deviceVerificationHandler.CompleteVerification(w, req, dc, err)
+		return
+	default:
+		dc.User = u
+	}
+
+	completed, completeErr := gt.CompleteDeviceCode(dc.DeviceCode, dc.User, dc.Denied)
+	switch {
+	case completeErr != nil:
+		err = ErrServerError
+	case !completed:
+		err = ErrInvalidGrant
+	}
+
+	s.deviceVerificationHandler.CompleteVerification(w, req, dc, err)
+}
+
+// generateUserCode generates a random user code, with it's characters uniformly picked from the
+// userCodeCharset.
+func generateUserCode() (string, error) {
+	// Random bytes above the largest multiple of the charset length are discarded, so every
+	// character is equally likely.
+	limit := byte(256 - 256%len(userCodeCharset))
+	code := make([]byte, 0, userCodeLength)
+
+	for len(code) < userCodeLength {
+		b, err := security.Random(userCodeLength)
+		if err != nil {
+			return "", err
+		}
+
+		for _, c := range b {
+			if c < limit && len(code) < userCodeLength {
+				code = append(code, userCodeCharset[int(c)%len(userCodeCharset)])
+			}
+		}
+	}
+
+	return string(code), nil
+}
+
+// formatUserCode splits the user code in two halves separated by a dash, making it easier to read.
+func formatUserCode(code string) string {
+	return code[:len(code)/2] + "-" + code[len(code)/2:]
+}
+
+// normalizeUserCode converts the user code entered by the user back to it's canonical form, ignoring
+// case, dashes and any other character that can't be part of the code.
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(userCodeCharset, r) {
+			return r
+		}
+		return -1
+	}, strings.ToUpper(code))
+}
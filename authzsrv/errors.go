@@ -79,4 +79,52 @@ var (
 		Code: http.StatusBadRequest,
 		Desc: "The authorization grant type is not supported by the authorization server.",
 	}
+
+	ErrAuthorizationPending = OAuth2Error{
+		ID:   "authorization_pending",
+		Code: http.StatusBadRequest,
+		Desc: "The authorization request is still pending as the end user hasn't yet completed the user-interaction steps.",
+	}
+
+	ErrSlowDown = OAuth2Error{
+		ID:   "slow_down",
+		Code: http.StatusBadRequest,
+		Desc: "The authorization request is still pending and polling should continue, but the interval must be increased by 5 seconds for this and all subsequent requests.",
+	}
+
+	ErrExpiredToken = OAuth2Error{
+		ID:   "expired_token",
+		Code: http.StatusBadRequest,
+		Desc: "The device_code has expired, and the device authorization session has concluded.",
+	}
+
+	ErrDeviceAccessDenied = OAuth2Error{
+		ID:   "access_denied",
+		Code: http.StatusBadRequest,
+		Desc: "The authorization request was denied.",
+	}
+
+	ErrInvalidTarget = OAuth2Error{
+		ID:   "invalid_target",
+		Code: http.StatusBadRequest,
+		Desc: "The authorization server is unwilling or unable to issue a token for any target service indicated by the resource or audience parameters.",
+	}
+
+	ErrInvalidToken = OAuth2Error{
+		ID:   "invalid_token",
+		Code: http.StatusUnauthorized,
+		Desc: "The access token provided is expired, revoked, malformed, or invalid for other reasons.",
+	}
+
+	ErrInsufficientScope = OAuth2Error{
+		ID:   "insufficient_scope",
+		Code: http.StatusForbidden,
+		Desc: "The request requires higher privileges than provided by the access token.",
+	}
+
+	ErrUnsupportedResponseType = OAuth2Error{
+		ID:   "unsupported_response_type",
+		Code: http.StatusBadRequest,
+		Desc: "The authorization server does not support obtaining an authorization code using this method.",
+	}
 )
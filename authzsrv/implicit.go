@@ -0,0 +1,84 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gostack/option"
+)
+
+// ResponseTypeToken is the response type of the implicit grant, as defined by
+// https://tools.ietf.org/html/rfc6749#section-4.2.1
+const ResponseTypeToken = "token"
+
+// DefaultImplicitTokenLifetime is the lifetime of tokens issued by the Implicit strategy when none is
+// configured.
+const DefaultImplicitTokenLifetime = 1 * time.Hour
+
+// Implicit implements the standard OAuth2 Implicit grant type, issuing access tokens directly from
+// the authorization endpoint in the fragment of the redirection URI, as described by
+// https://tools.ietf.org/html/rfc6749#section-4.2
+//
+// Since tokens are exposed to the user-agent, the implicit grant is only supported for legacy
+// clients and must be enabled with Server.EnableImplicitGrant in addition to the strategy being
+// registered. Refresh tokens are never issued along with implicit tokens.
+type Implicit struct {
+	// TokenLifetime is the duration for which issued tokens are valid.
+	TokenLifetime time.Duration
+}
+
+// ResponseType registers the token response type for Implicit.
+func (s Implicit) ResponseType(_ Persistence) (option.String, AuthorizationResponseType) {
+	lifetime := s.TokenLifetime
+	if lifetime == 0 {
+		lifetime = DefaultImplicitTokenLifetime
+	}
+
+	return option.SomeString(ResponseTypeToken), ImplicitResponseType{lifetime}
+}
+
+// GrantType simply registers a nil TokenGrantType for Implicit, as tokens are never requested from
+// the token endpoint.
+func (s Implicit) GrantType(_ Persistence) (option.String, TokenGrantType) {
+	return option.NoneString(), nil
+}
+
+// ImplicitResponseType implements the AuthorizationResponseType to allow for OAuth2's token
+// response type.
+type ImplicitResponseType struct {
+	lifetime time.Duration
+}
+
+// Confirm accepts every request approved by the user, as the implicit grant is enabled on the
+// Server itself.
+func (rt ImplicitResponseType) Confirm(_ *UserAuthorizationRequest, _ http.ResponseWriter) error {
+	return nil
+}
+
+// Authorize issues a new access token for the request approved by the user, as defined by
+// https://tools.ietf.org/html/rfc6749#section-4.2.2
+func (rt ImplicitResponseType) Authorize(ar *UserAuthorizationRequest) (*UserAuthorization, error) {
+	at, err := NewAccessToken(&ar.Client, ar.User, ar.Scope)
+	if err != nil {
+		return nil, ErrServerError
+	}
+	at.ExpiresIn = rt.lifetime
+
+	return &UserAuthorization{UserAuthorizationRequest: *ar, AccessToken: at}, nil
+}
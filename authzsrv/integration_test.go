@@ -17,14 +17,35 @@ limitations under the License.
 package authzsrv_test
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/russellhaering/goxmldsig"
+	"github.com/satori/go.uuid"
 
 	"github.com/gostack/oauth22/authzsrv"
+	"github.com/gostack/oauth22/jose"
+	"github.com/gostack/oauth22/security"
 )
 
 // TestUnsupportedGrantType ensures that clients sending an unsupported grant type will receive the
@@ -48,7 +69,7 @@ func TestUnsupportedGrantType(t *testing.T) {
 // Password Credential grant type, ensuring a proper access token is issued at the end.
 func TestResourceOwnerPasswordCredentialsSuccessful(t *testing.T) {
 	srvURL, teardown, client, user := setupTestServer(t, []authzsrv.Strategy{
-		authzsrv.ResourceOwnerPasswordCredentials{},
+		authzsrv.ResourceOwnerPasswordCredentials{Hashers: testPasswordHashers},
 	})
 	defer teardown()
 
@@ -56,13 +77,64 @@ func TestResourceOwnerPasswordCredentialsSuccessful(t *testing.T) {
 		"grant_type": []string{"password"},
 		"scope":      []string{"basic email"},
 		"username":   []string{user.Username},
-		"password":   []string{string(user.Password)},
+		"password":   []string{testPassword},
 	})
 	defer resp.Body.Close()
 
 	verifyResponseOK(t, resp)
 }
 
+// TestResourceOwnerPasswordCredentialsRehash verifies that password hashes produced by another
+// algorithm than the preferred one are upgraded on login.
+func TestResourceOwnerPasswordCredentialsRehash(t *testing.T) {
+	bcrypt := security.BcryptHasher{Cost: 4}
+	hashers := append(security.PasswordHashers{}, testPasswordHashers...)
+	hashers = append(hashers, bcrypt)
+
+	var users *authzsrv.InMemoryPersistence
+	srvURL, teardown, client, user := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.ResourceOwnerPasswordCredentials{Hashers: hashers},
+	}, func(_ *authzsrv.Server, p *authzsrv.InMemoryPersistence) {
+		users = p
+	})
+	defer teardown()
+
+	legacy := authzsrv.User{Username: user.Username}
+	if err := legacy.SetPassword(security.PasswordHashers{bcrypt}, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	users.RegisterUser(&legacy)
+
+	for _, e := range []struct {
+		Password string
+		Err      *authzsrv.OAuth2Error
+	}{
+		{Password: "wrong", Err: &authzsrv.ErrAccessDenied},
+		{Password: testPassword},
+	} {
+		resp := doTokenRequest(t, srvURL, &client, url.Values{
+			"grant_type": []string{"password"},
+			"username":   []string{user.Username},
+			"password":   []string{e.Password},
+		})
+		defer resp.Body.Close()
+
+		if e.Err != nil {
+			verifyResponseErr(t, resp, *e.Err)
+		} else {
+			verifyResponseOK(t, resp)
+		}
+	}
+
+	u, err := users.LoadUserFromUsername(user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(u.PasswordHash, "$argon2id$") {
+		t.Fatalf("password hash was not upgraded: %s", u.PasswordHash)
+	}
+}
+
 // TestClientCredentialsSuccessful verifies the happy path for the client credential flow,
 // ensuring a proper access token is issued at the end.
 func TestClientCredentialsSuccessful(t *testing.T) {
@@ -99,71 +171,1988 @@ func TestClientCredentialsInvalidCredentials(t *testing.T) {
 	verifyResponseErr(t, resp, authzsrv.ErrInvalidClient)
 }
 
-// setupTestServer builds the server configuration on top of httptest in order to run requests
-// against it. It returns the URL for the test server instance and a teardown function.
-func setupTestServer(t *testing.T, strategies []authzsrv.Strategy) (string, func(), authzsrv.Client, authzsrv.User) {
-	persistence := authzsrv.NewInMemoryPersistence()
-
-	c := authzsrv.Client{Name: "3rd party client"}
-	if err := c.GenerateCredentials(); err != nil {
-		t.Fatal(err)
-	}
-	persistence.RegisterClient(&c)
-
-	u := authzsrv.User{Username: "john", Password: []byte("password")}
-	persistence.RegisterUser(&u)
+// TestClientAuthMethods ensures clients can only authenticate with the method they were registered
+// for, and that custom methods can be registered.
+func TestClientAuthMethods(t *testing.T) {
+	custom := newTestClient(t, authzsrv.Client{Name: "custom client", TokenEndpointAuthMethod: "api_key"})
 
-	srv := authzsrv.NewServer(persistence)
+	srvURL, teardown, client, _ := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.ClientCredentials{},
+	}, func(srv *authzsrv.Server, p *authzsrv.InMemoryPersistence) {
+		p.RegisterClient(&custom.Client)
+		srv.RegisterClientAuthenticator(apiKeyAuthenticator{&custom.Client})
+	})
+	defer teardown()
 
-	for _, st := range strategies {
-		srv.RegisterStrategy(st)
+	post := url.Values{
+		"grant_type":    []string{"client_credentials"},
+		"client_id":     []string{client.ID.String()},
+		"client_secret": []string{client.Secret.String()},
 	}
 
-	httpSrv := httptest.NewServer(srv)
-	return httpSrv.URL, httpSrv.Close, c, u
-}
+	resp := doPostRequest(t, srvURL+"/token", post)
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidClient)
 
-// doTokenRequest performs a request to the token endpoint with the provided grantType and scope
-func doTokenRequest(t *testing.T, srvURL string, client *authzsrv.Client, q url.Values) *http.Response {
-	req, err := http.NewRequest("POST", srvURL+"/token", strings.NewReader(q.Encode()))
+	resp = doClientRequest(t, srvURL+"/token", &client, post)
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidRequest)
+
+	req, err := http.NewRequest("POST", srvURL+"/token", strings.NewReader("grant_type=client_credentials"))
 	if err != nil {
 		t.Fatal(err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.SetBasicAuth(client.ID.String(), client.Secret.String())
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("X-Api-Key", "secret key")
+
+	resp, err = http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer resp.Body.Close()
+	verifyResponseOK(t, resp)
+}
 
-	t.Logf("%#v\n", resp)
-	return resp
+// apiKeyAuthenticator is a custom client authentication method, accepting a static key for a
+// single client.
+type apiKeyAuthenticator struct {
+	client *authzsrv.Client
 }
 
-// verifyResponseOK verifies that the http response is a successfull one.
-func verifyResponseOK(t *testing.T, resp *http.Response) {
-	if resp.StatusCode != 200 {
-		t.Fatalf("unexpected status code: %d (expected %d)", resp.StatusCode, 200)
+func (ca apiKeyAuthenticator) Method() string {
+	return "api_key"
+}
+
+func (ca apiKeyAuthenticator) Detect(req *http.Request) bool {
+	return req.Header.Get("X-Api-Key") != ""
+}
+
+func (ca apiKeyAuthenticator) AuthenticateClient(req *http.Request) (*authzsrv.Client, error) {
+	if req.Header.Get("X-Api-Key") != "secret key" {
+		return nil, authzsrv.ErrInvalidClient
 	}
+	return ca.client, nil
+}
 
-	tokenResponse := struct {
-		AccessToken  string `json:"access_token"`
-		ExpiresIn    int    `json:"expires_in"`
-		RefreshToken string `json:"refresh_token"`
-	}{}
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
-		t.Fatal(err)
+// TestScopes verifies that requested scopes are validated against the scopes known by the server
+// and the ones allowed for the client, granting the default scopes when none are requested.
+func TestScopes(t *testing.T) {
+	client := newTestClient(t, authzsrv.Client{Name: "scoped client", Scopes: []string{"read", "write"}})
+
+	srvURL, teardown, _, _ := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.ClientCredentials{},
+	}, func(srv *authzsrv.Server, p *authzsrv.InMemoryPersistence) {
+		p.RegisterClient(&client.Client)
+		srv.RegisterScope(authzsrv.Scope{Name: "read", Description: "Read your data", Default: true})
+		srv.RegisterScope(authzsrv.Scope{Name: "write", Description: "Modify your data"})
+		srv.RegisterScope(authzsrv.Scope{Name: "admin", Description: "Administer your account"})
+	})
+	defer teardown()
+
+	for _, e := range []struct {
+		Scope   string
+		Granted string
+		Err     *authzsrv.OAuth2Error
+	}{
+		{Scope: "", Granted: "read"},
+		{Scope: "write read write", Granted: "write read"},
+		{Scope: "read admin", Granted: "read"},
+		{Scope: "admin", Err: &authzsrv.ErrInvalidScope},
+		{Scope: "read unknown", Err: &authzsrv.ErrInvalidScope},
+	} {
+		resp := doTokenRequest(t, srvURL, &client, url.Values{
+			"grant_type": []string{"client_credentials"},
+			"scope":      []string{e.Scope},
+		})
+		defer resp.Body.Close()
+
+		if e.Err != nil {
+			verifyResponseErr(t, resp, *e.Err)
+		} else if tr := verifyResponseOK(t, resp); tr.Scope != e.Granted {
+			t.Fatalf("unexpected scope %q for %q (expected %q)", tr.Scope, e.Scope, e.Granted)
+		}
 	}
+}
 
-	if tokenResponse.AccessToken == "" {
-		t.Fatal("access token response does not contain a token")
+// TestAuthorizationCodeSuccessful verifies the happy path for the Authorization Code grant type,
+// ensuring the issued code can be exchanged only once for an access token.
+func TestAuthorizationCodeSuccessful(t *testing.T) {
+	srvURL, teardown, client, _ := setupTestServer(t, []authzsrv.Strategy{
+		authzsrv.AuthorizationCode{},
+	})
+	defer teardown()
+
+	resp := doAuthorizeRequest(t, srvURL, url.Values{
+		"response_type": []string{"code"},
+		"client_id":     []string{client.ID.String()},
+		"scope":         []string{"basic email"},
+		"state":         []string{"xyz"},
+	})
+	defer resp.Body.Close()
+
+	params := verifyRedirect(t, resp, client.RedirectURI)
+	if params.Get("state") != "xyz" {
+		t.Fatalf("unexpected state %q (expected %q)", params.Get("state"), "xyz")
+	}
+
+	code := params.Get("code")
+	if code == "" {
+		t.Fatal("authorization response does not contain a code")
+	}
+
+	q := url.Values{
+		"grant_type": []string{"authorization_code"},
+		"code":       []string{code},
 	}
+
+	resp = doTokenRequest(t, srvURL, &client, q)
+	defer resp.Body.Close()
+	verifyResponseOK(t, resp)
+
+	resp = doTokenRequest(t, srvURL, &client, q)
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidGrant)
 }
 
-// verifyResponseErr verifies that the http response is a error one
-func verifyResponseErr(t *testing.T, resp *http.Response, expectedErr authzsrv.OAuth2Error) {
-	if resp.StatusCode != expectedErr.Code {
-		t.Fatalf("unexpected status code: %d (expected %d)", resp.StatusCode, expectedErr.Code)
+// TestAuthorizationCodeRedirectURIMismatch ensures the authorization endpoint never redirects to a
+// URI that was not registered for the client, and that a code can only be exchanged with the
+// redirection URI used to obtain it.
+func TestAuthorizationCodeRedirectURIMismatch(t *testing.T) {
+	srvURL, teardown, client, _ := setupTestServer(t, []authzsrv.Strategy{
+		authzsrv.AuthorizationCode{},
+	})
+	defer teardown()
+
+	resp := doAuthorizeRequest(t, srvURL, url.Values{
+		"response_type": []string{"code"},
+		"client_id":     []string{client.ID.String()},
+		"redirect_uri":  []string{"https://attacker.test/callback"},
+		"state":         []string{"xyz"},
+	})
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidRequest)
+
+	resp = doAuthorizeRequest(t, srvURL, url.Values{
+		"response_type": []string{"code"},
+		"client_id":     []string{client.ID.String()},
+		"redirect_uri":  []string{client.RedirectURI},
+		"state":         []string{"xyz"},
+	})
+	defer resp.Body.Close()
+	params := verifyRedirect(t, resp, client.RedirectURI)
+
+	resp = doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type": []string{"authorization_code"},
+		"code":       []string{params.Get("code")},
+	})
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidGrant)
+}
+
+// TestAuthorizationCodeUnsupportedResponseType ensures errors after the redirection URI has been
+// validated are sent back to the client.
+func TestAuthorizationCodeUnsupportedResponseType(t *testing.T) {
+	srvURL, teardown, client, _ := setupTestServer(t, []authzsrv.Strategy{
+		authzsrv.AuthorizationCode{},
+	})
+	defer teardown()
+
+	resp := doAuthorizeRequest(t, srvURL, url.Values{
+		"response_type": []string{"unsupported"},
+		"client_id":     []string{client.ID.String()},
+		"state":         []string{"xyz"},
+	})
+	defer resp.Body.Close()
+
+	params := verifyRedirect(t, resp, client.RedirectURI)
+	if params.Get("error") != authzsrv.ErrUnsupportedResponseType.ID {
+		t.Fatalf("unexpected error %s (expected %s)", params.Get("error"), authzsrv.ErrUnsupportedResponseType.ID)
+	}
+}
+
+// TestAuthorizationCodePKCE verifies that codes issued with a code challenge can only be exchanged
+// using the matching code verifier.
+func TestAuthorizationCodePKCE(t *testing.T) {
+	srvURL, teardown, client, _ := setupTestServer(t, []authzsrv.Strategy{
+		authzsrv.AuthorizationCode{ForbidPlainCodeChallenge: true},
+	})
+	defer teardown()
+
+	// Example from https://tools.ietf.org/html/rfc7636#appendix-B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	for _, e := range []struct {
+		Verifier string
+		Err      *authzsrv.OAuth2Error
+	}{
+		{Verifier: "", Err: &authzsrv.ErrInvalidGrant},
+		{Verifier: challenge, Err: &authzsrv.ErrInvalidGrant},
+		{Verifier: verifier},
+	} {
+		resp := doAuthorizeRequest(t, srvURL, url.Values{
+			"response_type":         []string{"code"},
+			"client_id":             []string{client.ID.String()},
+			"state":                 []string{"xyz"},
+			"code_challenge":        []string{challenge},
+			"code_challenge_method": []string{authzsrv.CodeChallengeS256},
+		})
+		defer resp.Body.Close()
+		params := verifyRedirect(t, resp, client.RedirectURI)
+
+		resp = doTokenRequest(t, srvURL, &client, url.Values{
+			"grant_type":    []string{"authorization_code"},
+			"code":          []string{params.Get("code")},
+			"code_verifier": []string{e.Verifier},
+		})
+		defer resp.Body.Close()
+
+		if e.Err != nil {
+			verifyResponseErr(t, resp, *e.Err)
+		} else {
+			verifyResponseOK(t, resp)
+		}
+	}
+
+	resp := doAuthorizeRequest(t, srvURL, url.Values{
+		"response_type":         []string{"code"},
+		"client_id":             []string{client.ID.String()},
+		"state":                 []string{"xyz"},
+		"code_challenge":        []string{verifier},
+		"code_challenge_method": []string{authzsrv.CodeChallengePlain},
+	})
+	defer resp.Body.Close()
+
+	params := verifyRedirect(t, resp, client.RedirectURI)
+	if params.Get("error") != authzsrv.ErrInvalidRequest.ID {
+		t.Fatalf("unexpected error %s (expected %s)", params.Get("error"), authzsrv.ErrInvalidRequest.ID)
+	}
+}
+
+// TestImplicit verifies that tokens are issued in the fragment of the redirection URI for the token
+// response type, without refresh tokens, and only once the implicit grant is enabled.
+func TestImplicit(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		var srv *authzsrv.Server
+
+		srvURL, teardown, client, user := setupTestServerWith(t, []authzsrv.Strategy{
+			authzsrv.Implicit{},
+			authzsrv.RefreshToken{},
+		}, func(s *authzsrv.Server, _ *authzsrv.InMemoryPersistence) {
+			srv = s
+			if enabled {
+				srv.EnableImplicitGrant()
+			}
+		})
+		defer teardown()
+
+		resp := doAuthorizeRequest(t, srvURL, url.Values{
+			"response_type": []string{"token"},
+			"client_id":     []string{client.ID.String()},
+			"scope":         []string{"basic"},
+			"state":         []string{"xyz"},
+		})
+		defer resp.Body.Close()
+
+		params := verifyRedirect(t, resp, client.RedirectURI)
+		if params.Get("state") != "xyz" {
+			t.Fatalf("unexpected state %q (expected %q)", params.Get("state"), "xyz")
+		}
+
+		grantTypes := []string{"refresh_token"}
+		if enabled {
+			grantTypes = []string{"implicit", "refresh_token"}
+		}
+		if m := srv.Metadata("https://authz.test"); !reflect.DeepEqual(m.GrantTypesSupported, grantTypes) {
+			t.Fatalf("unexpected grant types %v (expected %v)", m.GrantTypesSupported, grantTypes)
+		}
+
+		if !enabled {
+			if params.Get("error") != authzsrv.ErrUnsupportedResponseType.ID {
+				t.Fatalf("unexpected error %q (expected %q)", params.Get("error"), authzsrv.ErrUnsupportedResponseType.ID)
+			}
+			continue
+		}
+
+		if params.Get("token_type") != "Bearer" || params.Get("expires_in") != "3600" || params.Get("scope") != "basic" {
+			t.Fatalf("unexpected authorization response %v", params)
+		}
+		if params.Get("refresh_token") != "" {
+			t.Fatal("refresh token issued along with implicit token")
+		}
+
+		at, err := srv.LoadAccessToken(params.Get("access_token"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if at == nil || at.User.Username != user.Username || at.RefreshToken != "" {
+			t.Fatalf("unexpected access token %+v", at)
+		}
+	}
+}
+
+// TestPublicClient verifies that public clients can exchange codes with their client_id alone, as
+// long as they use PKCE, and that they can't use the client credentials grant type.
+func TestPublicClient(t *testing.T) {
+	client := authzsrv.Client{ID: uuid.NewV4(), Name: "public client", RedirectURI: "https://spa.test/callback"}
+
+	srvURL, teardown, _, _ := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.AuthorizationCode{},
+		authzsrv.ClientCredentials{},
+	}, func(_ *authzsrv.Server, p *authzsrv.InMemoryPersistence) {
+		p.RegisterClient(&client)
+	})
+	defer teardown()
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	resp := doAuthorizeRequest(t, srvURL, url.Values{
+		"response_type": []string{"code"},
+		"client_id":     []string{client.ID.String()},
+		"state":         []string{"xyz"},
+	})
+	defer resp.Body.Close()
+
+	params := verifyRedirect(t, resp, client.RedirectURI)
+	if params.Get("error") != authzsrv.ErrInvalidRequest.ID {
+		t.Fatalf("unexpected error %s (expected %s)", params.Get("error"), authzsrv.ErrInvalidRequest.ID)
+	}
+
+	resp = doAuthorizeRequest(t, srvURL, url.Values{
+		"response_type":         []string{"code"},
+		"client_id":             []string{client.ID.String()},
+		"state":                 []string{"xyz"},
+		"code_challenge":        []string{challenge},
+		"code_challenge_method": []string{authzsrv.CodeChallengeS256},
+	})
+	defer resp.Body.Close()
+	params = verifyRedirect(t, resp, client.RedirectURI)
+
+	resp = doPostRequest(t, srvURL+"/token", url.Values{
+		"grant_type":    []string{"authorization_code"},
+		"client_id":     []string{client.ID.String()},
+		"code":          []string{params.Get("code")},
+		"code_verifier": []string{verifier},
+	})
+	defer resp.Body.Close()
+	verifyResponseOK(t, resp)
+
+	resp = doPostRequest(t, srvURL+"/token", url.Values{
+		"grant_type": []string{"client_credentials"},
+		"client_id":  []string{client.ID.String()},
+	})
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrUnauthorizedClient)
+}
+
+// TestClientAllowedTypes ensures clients can only use the grant types and response types they were
+// registered for, and are only issued refresh tokens when allowed to use them.
+func TestClientAllowedTypes(t *testing.T) {
+	client := newTestClient(t, authzsrv.Client{
+		Name:          "restricted client",
+		RedirectURI:   "https://client.test/callback",
+		GrantTypes:    []string{"authorization_code"},
+		ResponseTypes: []string{"code"},
+	})
+	other := newTestClient(t, authzsrv.Client{
+		Name:          "other client",
+		RedirectURI:   "https://client.test/callback",
+		ResponseTypes: []string{"token"},
+	})
+
+	srvURL, teardown, _, _ := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.AuthorizationCode{},
+		authzsrv.ClientCredentials{},
+		authzsrv.RefreshToken{},
+	}, func(_ *authzsrv.Server, p *authzsrv.InMemoryPersistence) {
+		p.RegisterClient(&client.Client)
+		p.RegisterClient(&other.Client)
+	})
+	defer teardown()
+
+	resp := doAuthorizeRequest(t, srvURL, url.Values{
+		"response_type": []string{"code"},
+		"client_id":     []string{other.ID.String()},
+		"state":         []string{"xyz"},
+	})
+	defer resp.Body.Close()
+
+	params := verifyRedirect(t, resp, other.RedirectURI)
+	if params.Get("error") != authzsrv.ErrUnauthorizedClient.ID {
+		t.Fatalf("unexpected error %s (expected %s)", params.Get("error"), authzsrv.ErrUnauthorizedClient.ID)
+	}
+
+	resp = doAuthorizeRequest(t, srvURL, url.Values{
+		"response_type": []string{"code"},
+		"client_id":     []string{client.ID.String()},
+		"state":         []string{"xyz"},
+	})
+	defer resp.Body.Close()
+	params = verifyRedirect(t, resp, client.RedirectURI)
+
+	resp = doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type": []string{"authorization_code"},
+		"code":       []string{params.Get("code")},
+	})
+	defer resp.Body.Close()
+
+	if tr := verifyResponseOK(t, resp); tr.RefreshToken != "" {
+		t.Fatal("refresh token issued to client not allowed to use it")
+	}
+
+	resp = doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type": []string{"client_credentials"},
+	})
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrUnauthorizedClient)
+}
+
+// TestRefreshTokenRotation verifies that refresh tokens are rotated on each use, and that replaying
+// a used refresh token revokes the whole token family.
+func TestRefreshTokenRotation(t *testing.T) {
+	srvURL, teardown, client, user := setupTestServer(t, []authzsrv.Strategy{
+		authzsrv.ResourceOwnerPasswordCredentials{Hashers: testPasswordHashers},
+		authzsrv.RefreshToken{},
+	})
+	defer teardown()
+
+	resp := doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type": []string{"password"},
+		"scope":      []string{"basic email"},
+		"username":   []string{user.Username},
+		"password":   []string{testPassword},
+	})
+	defer resp.Body.Close()
+
+	first := verifyResponseOK(t, resp)
+	if first.RefreshToken == "" {
+		t.Fatal("access token response does not contain a refresh token")
+	}
+
+	resp = doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{first.RefreshToken},
+		"scope":         []string{"basic"},
+	})
+	defer resp.Body.Close()
+
+	second := verifyResponseOK(t, resp)
+	if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatal("refresh token was not rotated")
+	}
+
+	// Replaying the first refresh token revokes the whole family, including the second one.
+	for _, token := range []string{first.RefreshToken, second.RefreshToken} {
+		resp = doTokenRequest(t, srvURL, &client, url.Values{
+			"grant_type":    []string{"refresh_token"},
+			"refresh_token": []string{token},
+		})
+		defer resp.Body.Close()
+
+		verifyResponseErr(t, resp, authzsrv.ErrInvalidGrant)
+	}
+}
+
+// TestRefreshTokenInvalidScope ensures a refresh token can't be used to obtain a broader scope than
+// the one originally granted.
+func TestRefreshTokenInvalidScope(t *testing.T) {
+	srvURL, teardown, client, user := setupTestServer(t, []authzsrv.Strategy{
+		authzsrv.ResourceOwnerPasswordCredentials{Hashers: testPasswordHashers},
+		authzsrv.RefreshToken{},
+	})
+	defer teardown()
+
+	resp := doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type": []string{"password"},
+		"scope":      []string{"basic"},
+		"username":   []string{user.Username},
+		"password":   []string{testPassword},
+	})
+	defer resp.Body.Close()
+	tr := verifyResponseOK(t, resp)
+
+	resp = doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{tr.RefreshToken},
+		"scope":         []string{"basic email"},
+	})
+	defer resp.Body.Close()
+
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidScope)
+
+	// The refresh token is left untouched by the rejected request.
+	resp = doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{tr.RefreshToken},
+	})
+	defer resp.Body.Close()
+	verifyResponseOK(t, resp)
+}
+
+// TestRefreshTokenServerFailure ensures a refresh token is only rotated once the server issued the
+// new access token, so a failure on the server side doesn't use it up.
+func TestRefreshTokenServerFailure(t *testing.T) {
+	generator := &failingAccessTokenGenerator{}
+
+	srvURL, teardown, client, user := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.ResourceOwnerPasswordCredentials{Hashers: testPasswordHashers},
+		authzsrv.RefreshToken{},
+	}, func(srv *authzsrv.Server, _ *authzsrv.InMemoryPersistence) {
+		srv.SetAccessTokenGenerator(generator)
+	})
+	defer teardown()
+
+	resp := doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type": []string{"password"},
+		"scope":      []string{"basic"},
+		"username":   []string{user.Username},
+		"password":   []string{testPassword},
+	})
+	defer resp.Body.Close()
+	tr := verifyResponseOK(t, resp)
+
+	q := url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{tr.RefreshToken},
+	}
+
+	generator.fail = true
+	resp = doTokenRequest(t, srvURL, &client, q)
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrServerError)
+
+	generator.fail = false
+	resp = doTokenRequest(t, srvURL, &client, q)
+	defer resp.Body.Close()
+	verifyResponseOK(t, resp)
+}
+
+// TestRefreshTokenSaveFailure ensures the refresh token is only rotated once the new access token
+// was saved, so failing to save it doesn't revoke the token family.
+func TestRefreshTokenSaveFailure(t *testing.T) {
+	client := newTestClient(t, authzsrv.Client{Name: "3rd party client"})
+
+	user := authzsrv.User{Username: "john"}
+	if err := user.SetPassword(testPasswordHashers, testPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	persistence := &failingSavePersistence{InMemoryPersistence: authzsrv.NewInMemoryPersistence()}
+	persistence.RegisterClient(&client.Client)
+	persistence.RegisterUser(&user)
+
+	srv := authzsrv.NewServer(persistence)
+	srv.RegisterStrategy(authzsrv.ResourceOwnerPasswordCredentials{Hashers: testPasswordHashers})
+	srv.RegisterStrategy(authzsrv.RefreshToken{})
+
+	httpSrv := httptest.NewServer(srv)
+	defer httpSrv.Close()
+
+	resp := doTokenRequest(t, httpSrv.URL, &client, url.Values{
+		"grant_type": []string{"password"},
+		"scope":      []string{"basic"},
+		"username":   []string{user.Username},
+		"password":   []string{testPassword},
+	})
+	defer resp.Body.Close()
+	tr := verifyResponseOK(t, resp)
+
+	q := url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{tr.RefreshToken},
+	}
+
+	persistence.fail = true
+	resp = doTokenRequest(t, httpSrv.URL, &client, q)
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrServerError)
+
+	persistence.fail = false
+	resp = doTokenRequest(t, httpSrv.URL, &client, q)
+	defer resp.Body.Close()
+	refreshed := verifyResponseOK(t, resp)
+
+	if at, err := srv.LoadAccessToken(refreshed.AccessToken); err != nil || at == nil {
+		t.Fatalf("refreshed access token not saved (%v)", err)
+	}
+}
+
+// TestAccessTokenPersistence verifies that issued access tokens are persisted, so they can be
+// loaded and revoked later.
+func TestAccessTokenPersistence(t *testing.T) {
+	var srv *authzsrv.Server
+	srvURL, teardown, client, _ := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.ClientCredentials{},
+	}, func(s *authzsrv.Server, _ *authzsrv.InMemoryPersistence) {
+		srv = s
+	})
+	defer teardown()
+
+	resp := doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type": []string{"client_credentials"},
+		"scope":      []string{"basic email"},
+	})
+	defer resp.Body.Close()
+	tr := verifyResponseOK(t, resp)
+
+	at, err := srv.LoadAccessToken(tr.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at == nil {
+		t.Fatal("issued access token was not persisted")
+	}
+	if at.Client.ID != client.ID {
+		t.Fatalf("unexpected client %s (expected %s)", at.Client.ID, client.ID)
+	}
+
+	if err := srv.RevokeAccessToken(tr.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+
+	at, err = srv.LoadAccessToken(tr.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at != nil {
+		t.Fatal("revoked access token can still be loaded")
+	}
+}
+
+// TestIntrospection verifies that the introspection endpoint describes issued tokens, and reports
+// unknown ones as not active.
+func TestIntrospection(t *testing.T) {
+	srvURL, teardown, client, user := setupTestServer(t, []authzsrv.Strategy{
+		authzsrv.ResourceOwnerPasswordCredentials{Hashers: testPasswordHashers},
+	})
+	defer teardown()
+
+	resp := doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type": []string{"password"},
+		"scope":      []string{"basic email"},
+		"username":   []string{user.Username},
+		"password":   []string{testPassword},
+	})
+	defer resp.Body.Close()
+	tr := verifyResponseOK(t, resp)
+
+	resp = doClientRequest(t, srvURL+"/introspect", &client, url.Values{"token": []string{tr.AccessToken}})
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+
+	var ir authzsrv.IntrospectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ir); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := authzsrv.IntrospectionResponse{
+		Active:    true,
+		Scope:     "basic email",
+		ClientID:  client.ID.String(),
+		Username:  user.Username,
+		TokenType: "Bearer",
+		ExpiresAt: ir.IssuedAt + int64(tr.ExpiresIn),
+		IssuedAt:  ir.IssuedAt,
+	}
+	if !reflect.DeepEqual(ir, expected) {
+		t.Fatalf("unexpected introspection response %#v (expected %#v)", ir, expected)
+	}
+
+	resp = doClientRequest(t, srvURL+"/introspect", &client, url.Values{"token": []string{"unknown"}})
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("unexpected content type %s for an inactive token", ct)
+	}
+
+	ir = authzsrv.IntrospectionResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&ir); err != nil {
+		t.Fatal(err)
+	}
+	if ir.Active {
+		t.Fatal("unknown token reported as active")
+	}
+}
+
+// TestRevocation verifies that revoking a refresh token also revokes the access tokens issued with
+// it, and that clients can't revoke tokens issued to other clients.
+func TestRevocation(t *testing.T) {
+	other := newTestClient(t, authzsrv.Client{Name: "other client"})
+
+	srvURL, teardown, client, user := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.ResourceOwnerPasswordCredentials{Hashers: testPasswordHashers},
+		authzsrv.RefreshToken{},
+	}, func(_ *authzsrv.Server, p *authzsrv.InMemoryPersistence) {
+		p.RegisterClient(&other.Client)
+	})
+	defer teardown()
+
+	resp := doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type": []string{"password"},
+		"scope":      []string{"basic email"},
+		"username":   []string{user.Username},
+		"password":   []string{testPassword},
+	})
+	defer resp.Body.Close()
+	tr := verifyResponseOK(t, resp)
+
+	for _, e := range []struct {
+		Client *testClient
+		Token  string
+		Active bool
+	}{
+		{Client: &client, Token: "unknown", Active: true},
+		{Client: &other, Token: tr.RefreshToken, Active: true},
+		{Client: &client, Token: tr.RefreshToken, Active: false},
+	} {
+		resp = doClientRequest(t, srvURL+"/revoke", e.Client, url.Values{
+			"token":           []string{e.Token},
+			"token_type_hint": []string{"refresh_token"},
+		})
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d (expected %d)", resp.StatusCode, http.StatusOK)
+		}
+
+		resp = doClientRequest(t, srvURL+"/introspect", &client, url.Values{"token": []string{tr.AccessToken}})
+		defer resp.Body.Close()
+
+		var ir authzsrv.IntrospectionResponse
+		if err := json.NewDecoder(resp.Body).Decode(&ir); err != nil {
+			t.Fatal(err)
+		}
+		if ir.Active != e.Active {
+			t.Fatalf("unexpected access token state after revoking %s (expected active to be %t)", e.Token, e.Active)
+		}
+	}
+
+	resp = doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{tr.RefreshToken},
+	})
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidGrant)
+}
+
+// TestJWTAccessToken verifies that access tokens issued by a JWTAccessTokenGenerator can be
+// validated offline using the keys published by the server, even after the keys are rotated.
+func TestJWTAccessToken(t *testing.T) {
+	keys := authzsrv.NewRotatingKeyManager(generateSigningKey(t, "first"), time.Hour)
+
+	srvURL, teardown, client, user := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.ResourceOwnerPasswordCredentials{Hashers: testPasswordHashers},
+	}, func(srv *authzsrv.Server, _ *authzsrv.InMemoryPersistence) {
+		if _, err := authzsrv.NewJWTAccessTokenGenerator(srv, nil); err != authzsrv.ErrMissingAudience {
+			t.Fatalf("unexpected error %v for a generator without audience", err)
+		}
+
+		generator, err := authzsrv.NewJWTAccessTokenGenerator(srv, []string{"https://api.test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		srv.SetIssuer("https://authz.test")
+		srv.SetKeyManager(keys)
+		srv.SetAccessTokenGenerator(generator)
+	})
+	defer teardown()
+
+	resp := doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type": []string{"password"},
+		"scope":      []string{"basic email"},
+		"username":   []string{user.Username},
+		"password":   []string{testPassword},
+	})
+	defer resp.Body.Close()
+	tr := verifyResponseOK(t, resp)
+
+	// Rotating twice retires the key the token was signed with, which must still be published.
+	keys.Rotate(generateSigningKey(t, "second"))
+	keys.Rotate(generateSigningKey(t, "third"))
+
+	resp, err := http.Get(srvURL + "/.well-known/jwks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var jwks jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 3 {
+		t.Fatalf("unexpected number of published keys %d (expected %d)", len(jwks.Keys), 3)
+	}
+
+	claims, err := authzsrv.ParseJWTAccessToken(tr.AccessToken, jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Issuer != "https://authz.test" || !claims.Audience.Contains("https://api.test") {
+		t.Fatalf("unexpected issuer or audience %s %v", claims.Issuer, claims.Audience)
+	}
+	if claims.Subject != user.Username || claims.ClientID != client.ID.String() {
+		t.Fatalf("unexpected subject or client_id %s %s", claims.Subject, claims.ClientID)
+	}
+	if claims.Scope != "basic email" || claims.ID == "" {
+		t.Fatalf("unexpected scope or jti %s %s", claims.Scope, claims.ID)
+	}
+}
+
+// TestOpenIDConnect verifies that ID tokens are issued in the authorization code flow when the
+// openid scope is granted, bound to the nonce, code and access token.
+func TestOpenIDConnect(t *testing.T) {
+	key := generateSigningKey(t, "idtoken-key")
+
+	srvURL, teardown, client, user := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.AuthorizationCode{},
+	}, func(srv *authzsrv.Server, _ *authzsrv.InMemoryPersistence) {
+		srv.SetIssuer("https://authz.test")
+		srv.SetKeyManager(authzsrv.NewRotatingKeyManager(key, time.Hour))
+	})
+	defer teardown()
+
+	for _, scope := range []string{"openid basic", "basic"} {
+		resp := doAuthorizeRequest(t, srvURL, url.Values{
+			"response_type": []string{"code"},
+			"client_id":     []string{client.ID.String()},
+			"scope":         []string{scope},
+			"state":         []string{"xyz"},
+			"nonce":         []string{"n-0S6_WzA2Mj"},
+		})
+		defer resp.Body.Close()
+
+		code := verifyRedirect(t, resp, client.RedirectURI).Get("code")
+
+		resp = doTokenRequest(t, srvURL, &client, url.Values{
+			"grant_type": []string{"authorization_code"},
+			"code":       []string{code},
+		})
+		defer resp.Body.Close()
+		tr := verifyResponseOK(t, resp)
+
+		if scope == "basic" {
+			if tr.IDToken != "" {
+				t.Fatal("ID token issued without the openid scope")
+			}
+			continue
+		}
+
+		idToken, err := jose.Parse(tr.IDToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := idToken.Verify(key.Public()); err != nil {
+			t.Fatal(err)
+		}
+
+		var claims authzsrv.IDTokenClaims
+		if err := idToken.Claims(&claims); err != nil {
+			t.Fatal(err)
+		}
+		if err := claims.Validate(time.Now(), 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if claims.Issuer != "https://authz.test" || claims.Subject != user.Username || !claims.Audience.Contains(client.ID.String()) {
+			t.Fatalf("unexpected issuer, subject or audience %s %s %v", claims.Issuer, claims.Subject, claims.Audience)
+		}
+		if claims.Nonce != "n-0S6_WzA2Mj" || claims.AuthTime == 0 || claims.IssuedAt == 0 {
+			t.Fatalf("unexpected nonce, auth_time or iat %s %d %d", claims.Nonce, claims.AuthTime, claims.IssuedAt)
+		}
+
+		// Ed25519 keys use SHA-512 for the token hashes.
+		hash := func(v string) string {
+			sum := sha512.Sum512([]byte(v))
+			return base64.RawURLEncoding.EncodeToString(sum[:32])
+		}
+		if claims.AccessTokenHash != hash(tr.AccessToken) || claims.CodeHash != hash(code) {
+			t.Fatalf("unexpected at_hash or c_hash %s %s", claims.AccessTokenHash, claims.CodeHash)
+		}
+	}
+}
+
+// TestOpenIDConnectWithoutIssuer ensures that the openid scope is rejected at the authorization
+// endpoint when the server can't issue ID tokens, instead of failing once the code is exchanged.
+func TestOpenIDConnectWithoutIssuer(t *testing.T) {
+	key := generateSigningKey(t, "idtoken-key")
+
+	srvURL, teardown, client, _ := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.AuthorizationCode{},
+	}, func(srv *authzsrv.Server, _ *authzsrv.InMemoryPersistence) {
+		srv.SetKeyManager(authzsrv.NewRotatingKeyManager(key, time.Hour))
+	})
+	defer teardown()
+
+	resp := doAuthorizeRequest(t, srvURL, url.Values{
+		"response_type": []string{"code"},
+		"client_id":     []string{client.ID.String()},
+		"scope":         []string{"openid basic"},
+		"state":         []string{"xyz"},
+	})
+	defer resp.Body.Close()
+
+	params := verifyRedirect(t, resp, client.RedirectURI)
+	if params.Get("error") != authzsrv.ErrInvalidScope.ID || params.Get("code") != "" {
+		t.Fatalf("unexpected authorization response %v", params)
+	}
+}
+
+// TestUserInfo verifies that the userinfo endpoint returns the claims of the user allowed by the
+// scopes of the bearer token, and challenges requests with missing, invalid or insufficient tokens.
+func TestUserInfo(t *testing.T) {
+	verified := true
+
+	srvURL, teardown, client, user := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.ResourceOwnerPasswordCredentials{Hashers: testPasswordHashers},
+	}, func(_ *authzsrv.Server, p *authzsrv.InMemoryPersistence) {
+		p.RegisterUserClaims(&authzsrv.User{Username: "john"}, &authzsrv.UserClaims{
+			Name:          "John Doe",
+			Email:         "john@example.test",
+			EmailVerified: &verified,
+			PhoneNumber:   "+1 555 0100",
+		})
+	})
+	defer teardown()
+
+	issueToken := func(scope string) string {
+		resp := doTokenRequest(t, srvURL, &client, url.Values{
+			"grant_type": []string{"password"},
+			"scope":      []string{scope},
+			"username":   []string{user.Username},
+			"password":   []string{testPassword},
+		})
+		defer resp.Body.Close()
+		return verifyResponseOK(t, resp).AccessToken
+	}
+
+	for _, e := range []struct {
+		Token     string
+		Status    int
+		Challenge string
+		Claims    map[string]interface{}
+	}{
+		{
+			Token:  issueToken("openid email"),
+			Status: http.StatusOK,
+			Claims: map[string]interface{}{"sub": "john", "email": "john@example.test", "email_verified": true},
+		},
+		{
+			Token:  issueToken("openid profile"),
+			Status: http.StatusOK,
+			Claims: map[string]interface{}{"sub": "john", "name": "John Doe"},
+		},
+		{
+			Token:  issueToken("openid phone"),
+			Status: http.StatusOK,
+			Claims: map[string]interface{}{"sub": "john", "phone_number": "+1 555 0100"},
+		},
+		{Token: issueToken("email"), Status: http.StatusForbidden, Challenge: `Bearer error="insufficient_scope"`},
+		{Token: "unknown", Status: http.StatusUnauthorized, Challenge: `Bearer error="invalid_token"`},
+		{Status: http.StatusUnauthorized, Challenge: "Bearer"},
+	} {
+		req, err := http.NewRequest("GET", srvURL+"/userinfo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+e.Token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != e.Status {
+			t.Fatalf("unexpected status code: %d (expected %d)", resp.StatusCode, e.Status)
+		}
+		if resp.Header.Get("WWW-Authenticate") != e.Challenge {
+			t.Fatalf("unexpected challenge %q (expected %q)", resp.Header.Get("WWW-Authenticate"), e.Challenge)
+		}
+		if e.Claims == nil {
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("unexpected content type %s", ct)
+		}
+
+		var claims map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(claims, e.Claims) {
+			t.Fatalf("unexpected claims %v (expected %v)", claims, e.Claims)
+		}
+	}
+}
+
+// TestMetadata verifies that the server metadata reflects the registered strategies.
+func TestMetadata(t *testing.T) {
+	srvURL, teardown, _, _ := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.AuthorizationCode{ForbidPlainCodeChallenge: true},
+		authzsrv.ClientCredentials{},
+	}, func(srv *authzsrv.Server, _ *authzsrv.InMemoryPersistence) {
+		srv.SetIssuer("https://authz.test/")
+		srv.RegisterScope(authzsrv.Scope{Name: "read"})
+		srv.RegisterScope(authzsrv.Scope{Name: "email"})
+	})
+	defer teardown()
+
+	resp, err := http.Get(srvURL + "/.well-known/oauth-authorization-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+
+	var m authzsrv.ServerMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Issuer != "https://authz.test" || m.TokenEndpoint != "https://authz.test/token" {
+		t.Fatalf("unexpected issuer or token endpoint %s %s", m.Issuer, m.TokenEndpoint)
+	}
+	if m.AuthorizationEndpoint != "https://authz.test/authorize" {
+		t.Fatalf("unexpected authorization endpoint %s", m.AuthorizationEndpoint)
+	}
+	if !reflect.DeepEqual(m.GrantTypesSupported, []string{"authorization_code", "client_credentials"}) {
+		t.Fatalf("unexpected grant types %v", m.GrantTypesSupported)
+	}
+	if !reflect.DeepEqual(m.ResponseTypesSupported, []string{"code"}) {
+		t.Fatalf("unexpected response types %v", m.ResponseTypesSupported)
+	}
+	if !reflect.DeepEqual(m.CodeChallengeMethodsSupported, []string{"S256"}) {
+		t.Fatalf("unexpected code challenge methods %v", m.CodeChallengeMethodsSupported)
+	}
+	if m.JWKSURI != "" {
+		t.Fatalf("unexpected jwks_uri %s without a key manager", m.JWKSURI)
+	}
+	if !m.TLSClientCertificateBoundAccessTokens {
+		t.Fatal("certificate bound access tokens not advertised")
+	}
+	if !reflect.DeepEqual(m.ScopesSupported, []string{"email", "read"}) {
+		t.Fatalf("unexpected scopes %v", m.ScopesSupported)
+	}
+	if !reflect.DeepEqual(m.TokenEndpointAuthMethodsSupported, []string{"client_secret_basic", "client_secret_jwt", "client_secret_post", "none", "private_key_jwt", "self_signed_tls_client_auth", "tls_client_auth"}) {
+		t.Fatalf("unexpected token endpoint auth methods %v", m.TokenEndpointAuthMethodsSupported)
+	}
+}
+
+// TestMetadataWithoutIssuer ensures metadata is not published with an issuer derived from the
+// request when none is configured.
+func TestMetadataWithoutIssuer(t *testing.T) {
+	srvURL, teardown, _, _ := setupTestServer(t, []authzsrv.Strategy{
+		authzsrv.ClientCredentials{},
+	})
+	defer teardown()
+
+	resp, err := http.Get(srvURL + "/.well-known/oauth-authorization-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status code: %d (expected %d)", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+// testClient is a registered client along with it's plaintext secret, which is not kept by the
+// server.
+type testClient struct {
+	authzsrv.Client
+	Secret authzsrv.Secret
+}
+
+// newTestClient generates the credentials for the provided client.
+func newTestClient(t *testing.T, c authzsrv.Client) testClient {
+	secret, err := c.GenerateCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testClient{Client: c, Secret: secret}
+}
+
+// testPassword is the password of the user registered by setupTestServer.
+const testPassword = "password"
+
+// testPasswordHashers uses cheap parameters so tests run fast.
+var testPasswordHashers = security.PasswordHashers{
+	security.Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, SaltLength: 16, KeyLength: 32},
+}
+
+// TestDeviceCode verifies the device authorization grant, ensuring the device code can only be
+// exchanged once approved by the user in the verification page.
+func TestDeviceCode(t *testing.T) {
+	device := authzsrv.Client{ID: uuid.NewV4(), Name: "tv app"}
+
+	srvURL, teardown, _, _ := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.DeviceCode{Interval: 200 * time.Millisecond},
+	}, func(srv *authzsrv.Server, p *authzsrv.InMemoryPersistence) {
+		p.RegisterClient(&device)
+	})
+	defer teardown()
+
+	authorize := func() authzsrv.DeviceAuthorizationResponse {
+		resp := doPostRequest(t, srvURL+"/device_authorization", url.Values{
+			"client_id": []string{device.ID.String()},
+			"scope":     []string{"basic"},
+		})
+		defer resp.Body.Close()
+
+		var dar authzsrv.DeviceAuthorizationResponse
+		if err := json.NewDecoder(resp.Body).Decode(&dar); err != nil {
+			t.Fatal(err)
+		}
+		if dar.VerificationURI != srvURL+"/device" || dar.Interval != 1 || dar.ExpiresIn <= 0 {
+			t.Fatalf("unexpected device authorization response %#v", dar)
+		}
+
+		return dar
+	}
+
+	poll := func(dar authzsrv.DeviceAuthorizationResponse) *http.Response {
+		return doPostRequest(t, srvURL+"/token", url.Values{
+			"grant_type":  []string{authzsrv.GrantTypeDeviceCode},
+			"client_id":   []string{device.ID.String()},
+			"device_code": []string{dar.DeviceCode},
+		})
+	}
+
+	verify := func(q url.Values) string {
+		resp, err := http.Get(srvURL + "/device?" + q.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	dar := authorize()
+
+	resp := poll(dar)
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrAuthorizationPending)
+
+	resp = poll(dar)
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrSlowDown)
+
+	if body := verify(url.Values{"user_code": []string{"ZZZZ-ZZZZ"}}); body != "enter code" {
+		t.Fatalf("unexpected verification page %q for unknown user code", body)
+	}
+	if body := verify(url.Values{"user_code": []string{strings.ToLower(dar.UserCode)}}); body != "approved" {
+		t.Fatalf("unexpected verification page %q", body)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	resp = poll(dar)
+	defer resp.Body.Close()
+	if tr := verifyResponseOK(t, resp); tr.Scope != "basic" {
+		t.Fatalf("unexpected scope %s", tr.Scope)
+	}
+
+	resp = poll(dar)
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidGrant)
+
+	dar = authorize()
+	if body := verify(url.Values{"user_code": []string{dar.UserCode}, "deny": []string{"1"}}); body != "denied" {
+		t.Fatalf("unexpected verification page %q", body)
+	}
+
+	resp = poll(dar)
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrDeviceAccessDenied)
+}
+
+// TestTokenExchange verifies that a backend service can exchange a user's token for a narrower one
+// addressed to a downstream service, acting on behalf of the user, while other clients can't
+// exchange tokens that weren't issued to them.
+func TestTokenExchange(t *testing.T) {
+	backend := newTestClient(t, authzsrv.Client{Name: "backend service"})
+	intruder := newTestClient(t, authzsrv.Client{Name: "intruder"})
+
+	srvURL, teardown, client, user := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.ResourceOwnerPasswordCredentials{Hashers: testPasswordHashers},
+		authzsrv.ClientCredentials{},
+		authzsrv.RefreshToken{},
+		authzsrv.TokenExchange{Policy: downstreamTokenExchangePolicy{backend.ID}},
+	}, func(_ *authzsrv.Server, p *authzsrv.InMemoryPersistence) {
+		p.RegisterClient(&backend.Client)
+		p.RegisterClient(&intruder.Client)
+	})
+	defer teardown()
+
+	resp := doTokenRequest(t, srvURL, &client, url.Values{
+		"grant_type": []string{"password"},
+		"scope":      []string{"basic email"},
+		"username":   []string{user.Username},
+		"password":   []string{testPassword},
+	})
+	defer resp.Body.Close()
+	subject := verifyResponseOK(t, resp)
+
+	resp = doTokenRequest(t, srvURL, &backend, url.Values{"grant_type": []string{"client_credentials"}})
+	defer resp.Body.Close()
+	actor := verifyResponseOK(t, resp)
+
+	exchange := func(audience, scope string) *http.Response {
+		return doTokenRequest(t, srvURL, &backend, url.Values{
+			"grant_type":         []string{authzsrv.GrantTypeTokenExchange},
+			"subject_token":      []string{subject.AccessToken},
+			"subject_token_type": []string{authzsrv.TokenTypeAccessToken},
+			"actor_token":        []string{actor.AccessToken},
+			"actor_token_type":   []string{authzsrv.TokenTypeAccessToken},
+			"audience":           []string{audience},
+			"scope":              []string{scope},
+		})
+	}
+
+	resp = doTokenRequest(t, srvURL, &intruder, url.Values{
+		"grant_type":         []string{authzsrv.GrantTypeTokenExchange},
+		"subject_token":      []string{subject.AccessToken},
+		"subject_token_type": []string{authzsrv.TokenTypeAccessToken},
+		"audience":           []string{"https://downstream.test"},
+	})
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidGrant)
+
+	resp = exchange("https://other.test", "basic")
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidTarget)
+
+	resp = exchange("https://downstream.test", "basic admin")
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidScope)
+
+	resp = exchange("https://downstream.test", "basic")
+	defer resp.Body.Close()
+	tr := verifyResponseOK(t, resp)
+
+	if tr.Scope != "basic" || tr.RefreshToken != "" {
+		t.Fatalf("unexpected scope %q or refresh token %q", tr.Scope, tr.RefreshToken)
+	}
+
+	resp = doClientRequest(t, srvURL+"/introspect", &client, url.Values{"token": []string{tr.AccessToken}})
+	defer resp.Body.Close()
+
+	var ir authzsrv.IntrospectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ir); err != nil {
+		t.Fatal(err)
+	}
+
+	if ir.Username != user.Username || ir.ClientID != backend.ID.String() {
+		t.Fatalf("unexpected username or client_id %s %s", ir.Username, ir.ClientID)
+	}
+	if !reflect.DeepEqual(ir.Audience, jose.Audience{"https://downstream.test"}) {
+		t.Fatalf("unexpected audience %v", ir.Audience)
+	}
+	if ir.Actor == nil || ir.Actor.Subject != backend.ID.String() || ir.Actor.Actor != nil {
+		t.Fatalf("unexpected actor %#v", ir.Actor)
+	}
+}
+
+// TestTokenExchangeCertificateBound ensures that subject tokens bound to a client certificate can
+// only be exchanged over a connection using the same certificate.
+func TestTokenExchangeCertificateBound(t *testing.T) {
+	cert, other := generateCertificate(t), generateCertificate(t)
+
+	client := newTestClient(t, authzsrv.Client{
+		Name:                                  "bound client",
+		TLSClientCertificateBoundAccessTokens: true,
+	})
+
+	persistence := authzsrv.NewInMemoryPersistence()
+	persistence.RegisterClient(&client.Client)
+
+	srv := authzsrv.NewServer(persistence)
+	srv.RegisterStrategy(authzsrv.ClientCredentials{})
+	srv.RegisterStrategy(authzsrv.TokenExchange{})
+
+	httpSrv := httptest.NewUnstartedServer(srv)
+	httpSrv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	httpSrv.StartTLS()
+	defer httpSrv.Close()
+
+	request := func(cert tls.Certificate, q url.Values) *http.Response {
+		transport := httpSrv.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+		req, err := http.NewRequest("POST", httpSrv.URL+"/token", strings.NewReader(q.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID.String(), client.Secret.String())
+
+		resp, err := (&http.Client{Transport: transport}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := request(cert, url.Values{"grant_type": []string{"client_credentials"}})
+	defer resp.Body.Close()
+	subject := verifyResponseOK(t, resp)
+
+	q := url.Values{
+		"grant_type":         []string{authzsrv.GrantTypeTokenExchange},
+		"subject_token":      []string{subject.AccessToken},
+		"subject_token_type": []string{authzsrv.TokenTypeAccessToken},
+	}
+
+	resp = request(other, q)
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidGrant)
+
+	resp = request(cert, q)
+	defer resp.Body.Close()
+	verifyResponseOK(t, resp)
+}
+
+// downstreamTokenExchangePolicy allows tokens to be exchanged for narrower ones addressed to the
+// downstream service, trusting the backend service to exchange tokens issued to other clients.
+type downstreamTokenExchangePolicy struct {
+	backend uuid.UUID
+}
+
+func (p downstreamTokenExchangePolicy) AllowsForeignSubject(er *authzsrv.TokenExchangeRequest) bool {
+	return uuid.Equal(er.Client.ID, p.backend)
+}
+
+func (p downstreamTokenExchangePolicy) AuthorizeExchange(er *authzsrv.TokenExchangeRequest) ([]string, []string, error) {
+	if !reflect.DeepEqual(er.Audience, []string{"https://downstream.test"}) {
+		return nil, nil, authzsrv.ErrInvalidTarget
+	}
+
+	for _, scope := range er.Scopes {
+		found := false
+		for _, granted := range er.Subject.Scopes {
+			found = found || granted == scope
+		}
+		if !found {
+			return nil, nil, authzsrv.ErrInvalidScope
+		}
+	}
+
+	return er.Audience, er.Scopes, nil
+}
+
+// TestJWTBearer verifies that assertions issued by a trusted identity provider can be exchanged for
+// a token on behalf of the user, and that they can't be replayed.
+func TestJWTBearer(t *testing.T) {
+	key := generateSigningKey(t, "idp-key")
+	untrusted := generateSigningKey(t, "idp-key")
+
+	srvURL, teardown, client, user := setupTestServer(t, []authzsrv.Strategy{
+		authzsrv.JWTBearer{
+			Issuers: []authzsrv.TrustedIssuer{
+				{Issuer: "https://idp.test", Keys: jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jose.NewJSONWebKey(key)}}},
+			},
+			Audience: []string{"https://authz.test/token"},
+		},
+	})
+	defer teardown()
+
+	assertion := func(k *jose.SigningKey, sub, aud string) string {
+		signed, err := jose.Sign(k, "", jose.Claims{
+			Issuer:    "https://idp.test",
+			Subject:   sub,
+			Audience:  jose.Audience{aud},
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+			ID:        uuid.NewV4().String(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	valid := assertion(key, user.Username, "https://authz.test/token")
+
+	for _, e := range []struct {
+		Assertion string
+		Err       *authzsrv.OAuth2Error
+	}{
+		{Assertion: valid},
+		{Assertion: valid, Err: &authzsrv.ErrInvalidGrant},
+		{Assertion: assertion(key, "unknown", "https://authz.test/token"), Err: &authzsrv.ErrInvalidGrant},
+		{Assertion: assertion(key, user.Username, "https://other.test/token"), Err: &authzsrv.ErrInvalidGrant},
+		{Assertion: assertion(untrusted, user.Username, "https://authz.test/token"), Err: &authzsrv.ErrInvalidGrant},
+	} {
+		resp := doTokenRequest(t, srvURL, &client, url.Values{
+			"grant_type": []string{authzsrv.GrantTypeJWTBearer},
+			"assertion":  []string{e.Assertion},
+			"scope":      []string{"basic"},
+		})
+		defer resp.Body.Close()
+
+		if e.Err != nil {
+			verifyResponseErr(t, resp, *e.Err)
+		} else {
+			verifyResponseOK(t, resp)
+		}
+	}
+}
+
+// TestSAML2Bearer verifies that clients can exchange SAML assertions signed by a trusted identity
+// provider for access tokens, and that assertions can't be replayed or altered.
+func TestSAML2Bearer(t *testing.T) {
+	idp := generateCertificate(t)
+	untrusted := generateCertificate(t)
+
+	srvURL, teardown, client, user := setupTestServer(t, []authzsrv.Strategy{
+		authzsrv.SAML2Bearer{
+			IdentityProviders: []authzsrv.SAML2IdentityProvider{
+				{EntityID: "https://idp.test", Certificates: []*x509.Certificate{idp.Leaf}},
+			},
+			Audience:  []string{"https://authz.test"},
+			Recipient: "https://authz.test/token",
+		},
+	})
+	defer teardown()
+
+	assertion := func(cert tls.Certificate, nameID, aud string, tamper func(*etree.Element)) string {
+		now := time.Now().UTC()
+
+		a := etree.NewElement("saml:Assertion")
+		a.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+		a.CreateAttr("ID", "_"+uuid.NewV4().String())
+		a.CreateAttr("Version", "2.0")
+		a.CreateAttr("IssueInstant", now.Format(time.RFC3339))
+		a.CreateElement("saml:Issuer").SetText("https://idp.test")
+
+		subject := a.CreateElement("saml:Subject")
+		subject.CreateElement("saml:NameID").SetText(nameID)
+		sc := subject.CreateElement("saml:SubjectConfirmation")
+		sc.CreateAttr("Method", "urn:oasis:names:tc:SAML:2.0:cm:bearer")
+		scd := sc.CreateElement("saml:SubjectConfirmationData")
+		scd.CreateAttr("Recipient", "https://authz.test/token")
+		scd.CreateAttr("NotOnOrAfter", now.Add(time.Minute).Format(time.RFC3339))
+
+		conditions := a.CreateElement("saml:Conditions")
+		conditions.CreateAttr("NotBefore", now.Add(-time.Minute).Format(time.RFC3339))
+		conditions.CreateAttr("NotOnOrAfter", now.Add(time.Minute).Format(time.RFC3339))
+		conditions.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText(aud)
+
+		ctx, err := dsig.NewSigningContext(cert.PrivateKey.(crypto.Signer), cert.Certificate)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signed, err := ctx.SignEnveloped(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tamper != nil {
+			tamper(signed)
+		}
+
+		doc := etree.NewDocument()
+		doc.SetRoot(signed)
+		b, err := doc.WriteToBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	valid := assertion(idp, user.Username, "https://authz.test", nil)
+	tampered := assertion(idp, "unknown", "https://authz.test", func(a *etree.Element) {
+		a.FindElement("./Subject/NameID").SetText(user.Username)
+	})
+
+	for _, e := range []struct {
+		Assertion string
+		Err       *authzsrv.OAuth2Error
+	}{
+		{Assertion: valid},
+		{Assertion: valid, Err: &authzsrv.ErrInvalidGrant},
+		{Assertion: tampered, Err: &authzsrv.ErrInvalidGrant},
+		{Assertion: assertion(idp, "unknown", "https://authz.test", nil), Err: &authzsrv.ErrInvalidGrant},
+		{Assertion: assertion(idp, user.Username, "https://other.test", nil), Err: &authzsrv.ErrInvalidGrant},
+		{Assertion: assertion(untrusted, user.Username, "https://authz.test", nil), Err: &authzsrv.ErrInvalidGrant},
+		{Assertion: "not base64!", Err: &authzsrv.ErrInvalidRequest},
+	} {
+		resp := doTokenRequest(t, srvURL, &client, url.Values{
+			"grant_type": []string{authzsrv.GrantTypeSAML2Bearer},
+			"assertion":  []string{e.Assertion},
+			"scope":      []string{"basic"},
+		})
+		defer resp.Body.Close()
+
+		if e.Err != nil {
+			verifyResponseErr(t, resp, *e.Err)
+		} else {
+			verifyResponseOK(t, resp)
+		}
+	}
+}
+
+// TestClientAssertion verifies that clients can authenticate using JWT assertions signed with their
+// private key or JWT secret, and that assertions can't be replayed.
+func TestClientAssertion(t *testing.T) {
+	key := generateSigningKey(t, "client-key")
+
+	client := newTestClient(t, authzsrv.Client{
+		Name:                    "asserting client",
+		TokenEndpointAuthMethod: authzsrv.AuthMethodPrivateKeyJWT,
+		JWKS:                    jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jose.NewJSONWebKey(key)}},
+	})
+	secretClient := newTestClient(t, authzsrv.Client{
+		Name:                    "asserting client with secret",
+		TokenEndpointAuthMethod: authzsrv.AuthMethodClientSecretJWT,
+		JWTSecret:               authzsrv.Secret("shared secret"),
+	})
+
+	srvURL, teardown, _, _ := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.ClientCredentials{},
+	}, func(srv *authzsrv.Server, p *authzsrv.InMemoryPersistence) {
+		srv.SetIssuer("https://authz.test")
+		p.RegisterClient(&client.Client)
+		p.RegisterClient(&secretClient.Client)
+	})
+	defer teardown()
+
+	claims := func(c testClient, aud string) jose.Claims {
+		return jose.Claims{
+			Issuer:    c.ID.String(),
+			Subject:   c.ID.String(),
+			Audience:  jose.Audience{aud},
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+			ID:        uuid.NewV4().String(),
+		}
+	}
+
+	signed, err := jose.Sign(key, "", claims(client, "https://authz.test/token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmac, err := jose.SignHMAC(secretClient.JWTSecret, "", claims(secretClient, "https://authz.test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongAudience, err := jose.Sign(key, "", claims(client, "https://other.test/token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostAudience, err := jose.Sign(key, "", claims(client, srvURL+"/token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongMethod, err := jose.SignHMAC(secretClient.JWTSecret, "", claims(client, "https://authz.test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []struct {
+		Assertion string
+		Err       *authzsrv.OAuth2Error
+	}{
+		{Assertion: signed},
+		{Assertion: signed, Err: &authzsrv.ErrInvalidClient},
+		{Assertion: hmac},
+		{Assertion: wrongAudience, Err: &authzsrv.ErrInvalidClient},
+		{Assertion: hostAudience, Err: &authzsrv.ErrInvalidClient},
+		{Assertion: wrongMethod, Err: &authzsrv.ErrInvalidClient},
+	} {
+		resp := doPostRequest(t, srvURL+"/token", url.Values{
+			"grant_type":            []string{"client_credentials"},
+			"client_assertion_type": []string{authzsrv.ClientAssertionTypeJWTBearer},
+			"client_assertion":      []string{e.Assertion},
+		})
+		defer resp.Body.Close()
+
+		if e.Err != nil {
+			verifyResponseErr(t, resp, *e.Err)
+		} else {
+			verifyResponseOK(t, resp)
+		}
+	}
+}
+
+// TestMutualTLSClientAuth verifies that clients can authenticate using a self-signed certificate,
+// and that the issued access tokens are bound to it.
+func TestMutualTLSClientAuth(t *testing.T) {
+	cert := generateCertificate(t)
+
+	client := newTestClient(t, authzsrv.Client{
+		Name:                                  "mtls client",
+		TokenEndpointAuthMethod:               authzsrv.AuthMethodSelfSignedTLSClientAuth,
+		JWKS:                                  jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: cert.Leaf.PublicKey, Certificates: []*x509.Certificate{cert.Leaf}}}},
+		TLSClientCertificateBoundAccessTokens: true,
+	})
+
+	persistence := authzsrv.NewInMemoryPersistence()
+	persistence.RegisterClient(&client.Client)
+
+	srv := authzsrv.NewServer(persistence)
+	srv.RegisterStrategy(authzsrv.ClientCredentials{})
+
+	httpSrv := httptest.NewUnstartedServer(srv)
+	httpSrv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	httpSrv.StartTLS()
+	defer httpSrv.Close()
+
+	anonymous := httpSrv.Client()
+	transport := anonymous.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	mtls := &http.Client{Transport: transport}
+
+	q := url.Values{
+		"grant_type": []string{"client_credentials"},
+		"client_id":  []string{client.ID.String()},
+	}
+
+	resp, err := anonymous.PostForm(httpSrv.URL+"/token", q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidClient)
+
+	resp, err = mtls.PostForm(httpSrv.URL+"/token", q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	tr := verifyResponseOK(t, resp)
+
+	at, err := srv.LoadAccessToken(tr.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at.CertificateThumbprint != authzsrv.CertificateThumbprint(cert.Leaf) {
+		t.Fatalf("unexpected certificate thumbprint %s", at.CertificateThumbprint)
+	}
+	if !at.VerifyCertificate(cert.Leaf) || at.VerifyCertificate(nil) {
+		t.Fatal("access token not properly bound to the client certificate")
+	}
+}
+
+// TestCertificateBoundAccessTokenWithoutCertificate ensures that clients requiring certificate
+// bound access tokens keep the authorization grant when the request lacks the certificate.
+func TestCertificateBoundAccessTokenWithoutCertificate(t *testing.T) {
+	var persistence *authzsrv.InMemoryPersistence
+	srvURL, teardown, client, _ := setupTestServerWith(t, []authzsrv.Strategy{
+		authzsrv.AuthorizationCode{},
+	}, func(_ *authzsrv.Server, p *authzsrv.InMemoryPersistence) {
+		persistence = p
+	})
+	defer teardown()
+
+	bound := client.Client
+	bound.TLSClientCertificateBoundAccessTokens = true
+	persistence.RegisterClient(&bound)
+
+	resp := doAuthorizeRequest(t, srvURL, url.Values{
+		"response_type": []string{"code"},
+		"client_id":     []string{client.ID.String()},
+		"state":         []string{"xyz"},
+	})
+	defer resp.Body.Close()
+	params := verifyRedirect(t, resp, client.RedirectURI)
+
+	q := url.Values{
+		"grant_type": []string{"authorization_code"},
+		"code":       []string{params.Get("code")},
+	}
+
+	resp = doTokenRequest(t, srvURL, &client, q)
+	defer resp.Body.Close()
+	verifyResponseErr(t, resp, authzsrv.ErrInvalidRequest)
+
+	persistence.RegisterClient(&client.Client)
+
+	resp = doTokenRequest(t, srvURL, &client, q)
+	defer resp.Body.Close()
+	verifyResponseOK(t, resp)
+}
+
+// setupTestServer builds the server configuration on top of httptest in order to run requests
+// against it. It returns the URL for the test server instance and a teardown function.
+func setupTestServer(t *testing.T, strategies []authzsrv.Strategy) (string, func(), testClient, authzsrv.User) {
+	return setupTestServerWith(t, strategies, nil)
+}
+
+// setupTestServerWith works like setupTestServer, calling configure to further customize the server
+// and persistence before it starts handling requests.
+func setupTestServerWith(t *testing.T, strategies []authzsrv.Strategy, configure func(*authzsrv.Server, *authzsrv.InMemoryPersistence)) (string, func(), testClient, authzsrv.User) {
+	persistence := authzsrv.NewInMemoryPersistence()
+
+	c := newTestClient(t, authzsrv.Client{Name: "3rd party client", RedirectURI: "https://client.test/callback"})
+	persistence.RegisterClient(&c.Client)
+
+	u := authzsrv.User{Username: "john"}
+	if err := u.SetPassword(testPasswordHashers, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	persistence.RegisterUser(&u)
+
+	srv := authzsrv.NewServer(persistence)
+	srv.SetUserAuthorizationHandler(approvingUserAuthorizationHandler{&u})
+	srv.SetDeviceVerificationHandler(testDeviceVerificationHandler{&u})
+
+	for _, st := range strategies {
+		srv.RegisterStrategy(st)
+	}
+
+	if configure != nil {
+		configure(srv, persistence)
+	}
+
+	httpSrv := httptest.NewServer(srv)
+	return httpSrv.URL, httpSrv.Close, c, u
+}
+
+// generateSigningKey generates a new Ed25519 signing key with the provided ID.
+func generateSigningKey(t *testing.T, id string) *jose.SigningKey {
+	_, pk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := jose.NewSigningKey(id, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// generateCertificate generates a self-signed client certificate.
+func generateCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// failingAccessTokenGenerator is an AccessTokenGenerator that fails while fail is set, generating
+// random tokens otherwise.
+type failingAccessTokenGenerator struct {
+	fail bool
+}
+
+func (g *failingAccessTokenGenerator) GenerateAccessToken(at *authzsrv.AccessToken) (string, error) {
+	if g.fail {
+		return "", errors.New("generator failure")
+	}
+
+	return uuid.NewV4().String(), nil
+}
+
+// failingSavePersistence is an InMemoryPersistence that fails to save access tokens while fail is
+// set.
+type failingSavePersistence struct {
+	*authzsrv.InMemoryPersistence
+	fail bool
+}
+
+func (p *failingSavePersistence) SaveAccessToken(at *authzsrv.AccessToken) error {
+	if p.fail {
+		return errors.New("save failure")
+	}
+
+	return p.InMemoryPersistence.SaveAccessToken(at)
+}
+
+// approvingUserAuthorizationHandler is a UserAuthorizationHandler that approves every request on
+// behalf of the same user.
+type approvingUserAuthorizationHandler struct {
+	user *authzsrv.User
+}
+
+func (h approvingUserAuthorizationHandler) AuthorizeUser(w http.ResponseWriter, req *http.Request, ar *authzsrv.UserAuthorizationRequest) (*authzsrv.User, error) {
+	return h.user, nil
+}
+
+// testDeviceVerificationHandler is a DeviceVerificationHandler that approves requests on behalf of
+// the same user, unless the deny parameter is provided.
+type testDeviceVerificationHandler struct {
+	user *authzsrv.User
+}
+
+func (h testDeviceVerificationHandler) VerifyUser(w http.ResponseWriter, req *http.Request, dc *authzsrv.UserDeviceCode) (*authzsrv.User, error) {
+	if dc == nil {
+		io.WriteString(w, "enter code")
+		return nil, nil
+	}
+	if req.FormValue("deny") != "" {
+		return nil, authzsrv.ErrAccessDenied
+	}
+	return h.user, nil
+}
+
+func (h testDeviceVerificationHandler) CompleteVerification(w http.ResponseWriter, req *http.Request, dc *authzsrv.UserDeviceCode, err error) {
+	switch err {
+	case nil:
+		io.WriteString(w, "approved")
+	case authzsrv.ErrAccessDenied:
+		io.WriteString(w, "denied")
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// doAuthorizeRequest performs a request to the authorization endpoint with the provided parameters,
+// without following redirects.
+func doAuthorizeRequest(t *testing.T, srvURL string, q url.Values) *http.Response {
+	httpClient := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := httpClient.Get(srvURL + "/authorize?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+// verifyRedirect verifies that the http response redirects to the expected URI, and returns the
+// parameters sent along with it, either in the query or fragment component.
+func verifyRedirect(t *testing.T, resp *http.Response, expectedURI string) url.Values {
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("unexpected status code: %d (expected %d)", resp.StatusCode, http.StatusFound)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := location.Query()
+	if location.Fragment != "" {
+		if params, err = url.ParseQuery(location.Fragment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	location.RawQuery = ""
+	location.Fragment = ""
+	if location.String() != expectedURI {
+		t.Fatalf("unexpected redirect to %s (expected %s)", location, expectedURI)
+	}
+
+	return params
+}
+
+// doTokenRequest performs a request to the token endpoint with the provided grantType and scope
+func doTokenRequest(t *testing.T, srvURL string, client *testClient, q url.Values) *http.Response {
+	return doClientRequest(t, srvURL+"/token", client, q)
+}
+
+// doPostRequest performs a form request to the provided endpoint, without authenticating the client.
+func doPostRequest(t *testing.T, endpoint string, q url.Values) *http.Response {
+	resp, err := http.PostForm(endpoint, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+// doClientRequest performs a request authenticated by the client to the provided endpoint.
+func doClientRequest(t *testing.T, endpoint string, client *testClient, q url.Values) *http.Response {
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(q.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ID.String(), client.Secret.String())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("%#v\n", resp)
+	return resp
+}
+
+// tokenResponse is the response sent by the token endpoint on success.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	IDToken      string `json:"id_token"`
+}
+
+// verifyResponseOK verifies that the http response is a successfull one, and returns the token
+// response it contains.
+func verifyResponseOK(t *testing.T, resp *http.Response) tokenResponse {
+	if resp.StatusCode != 200 {
+		t.Fatalf("unexpected status code: %d (expected %d)", resp.StatusCode, 200)
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" || resp.Header.Get("Pragma") != "no-cache" {
+		t.Fatalf("unexpected cache headers %q %q", resp.Header.Get("Cache-Control"), resp.Header.Get("Pragma"))
+	}
+
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.AccessToken == "" {
+		t.Fatal("access token response does not contain a token")
+	}
+
+	return tr
+}
+
+// verifyResponseErr verifies that the http response is a error one
+func verifyResponseErr(t *testing.T, resp *http.Response, expectedErr authzsrv.OAuth2Error) {
+	if resp.StatusCode != expectedErr.Code {
+		t.Fatalf("unexpected status code: %d (expected %d)", resp.StatusCode, expectedErr.Code)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("unexpected content type %s", ct)
 	}
 
 	errResponse := struct {
@@ -175,6 +2164,6 @@ func verifyResponseErr(t *testing.T, resp *http.Response, expectedErr authzsrv.O
 	}
 
 	if errResponse.Error != expectedErr.ID {
-		t.Fatal("unexpected error %s (expected %s)", errResponse.Error, expectedErr.ID)
+		t.Fatalf("unexpected error %s (expected %s)", errResponse.Error, expectedErr.ID)
 	}
 }
@@ -0,0 +1,101 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gostack/oauth22/jose"
+)
+
+// IntrospectionResponse is the response of the token introspection endpoint, as defined by
+// https://tools.ietf.org/html/rfc7662#section-2.2
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+
+	Audience jose.Audience `json:"aud,omitempty"`
+
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+	Actor        *Actor        `json:"act,omitempty"`
+}
+
+// NewIntrospectionResponse builds the IntrospectionResponse describing an active AccessToken.
+func NewIntrospectionResponse(at *AccessToken) *IntrospectionResponse {
+	ir := IntrospectionResponse{
+		Active:    true,
+		Scope:     strings.Join(at.Scopes, " "),
+		ClientID:  at.Client.ID.String(),
+		TokenType: "Bearer",
+		ExpiresAt: at.ExpiresAt().Unix(),
+		IssuedAt:  at.IssuedAt.Unix(),
+
+		Audience: at.Audience,
+
+		Confirmation: newConfirmation(at),
+		Actor:        at.Actor,
+	}
+
+	if at.User != nil {
+		ir.Username = at.User.Username
+	}
+
+	return &ir
+}
+
+// introspectionEndpointHandler allows authenticated clients, usually resource servers, to obtain
+// information about an access token, as defined by https://tools.ietf.org/html/rfc7662
+func (s *Server) introspectionEndpointHandler(w http.ResponseWriter, req *http.Request) {
+	c, err := s.authenticateClientRequest(req)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	// Public clients can't be trusted with information about tokens issued to others.
+	if c.Public() {
+		respondError(w, ErrInvalidClient)
+		return
+	}
+
+	token := req.PostFormValue("token")
+	if token == "" {
+		respondError(w, ErrInvalidRequest)
+		return
+	}
+
+	at, err := s.LoadAccessToken(token)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	// Tokens that are unknown, expired or revoked are all simply reported as not active, not
+	// disclosing any further information about them.
+	if at == nil {
+		respondJSON(w, IntrospectionResponse{Active: false})
+		return
+	}
+
+	respondJSON(w, NewIntrospectionResponse(at))
+}
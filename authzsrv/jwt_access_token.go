@@ -0,0 +1,162 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/gostack/oauth22/jose"
+)
+
+// JWTAccessTokenType is the typ header of JWT access tokens, as defined by
+// https://tools.ietf.org/html/rfc9068#section-2.1
+const JWTAccessTokenType = "at+jwt"
+
+var (
+	ErrInvalidJWTAccessToken = errors.New("invalid JWT access token")
+	ErrMissingAudience       = errors.New("JWT access tokens require an audience")
+)
+
+// AccessTokenGenerator is the interface for objects that knows how to generate the token of an
+// AccessToken, allowing for other formats than the default opaque random token.
+type AccessTokenGenerator interface {
+	GenerateAccessToken(at *AccessToken) (string, error)
+}
+
+// JWTAccessTokenClaims are the claims of JWT access tokens, as defined by
+// https://tools.ietf.org/html/rfc9068#section-2.2
+type JWTAccessTokenClaims struct {
+	jose.Claims
+	ClientID     string        `json:"client_id"`
+	Scope        string        `json:"scope,omitempty"`
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+	Actor        *Actor        `json:"act,omitempty"`
+}
+
+// Confirmation is the cnf claim, binding a token to a proof-of-possession key, as defined by
+// https://tools.ietf.org/html/rfc7800#section-3.1
+type Confirmation struct {
+	CertificateThumbprint string `json:"x5t#S256,omitempty"`
+}
+
+// newConfirmation returns the Confirmation for the AccessToken, or nil if it's not bound.
+func newConfirmation(at *AccessToken) *Confirmation {
+	if at.CertificateThumbprint == "" {
+		return nil
+	}
+
+	return &Confirmation{CertificateThumbprint: at.CertificateThumbprint}
+}
+
+// Scopes returns the scopes granted to the token.
+func (c JWTAccessTokenClaims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// JWTAccessTokenGenerator is an AccessTokenGenerator which generates self-contained, signed access
+// tokens, allowing resource servers to validate them without calling back the authorization server.
+//
+// Tokens are issued by the Server the generator was built for, using it's issuer and signing them
+// with it's KeyManager, so they can be validated with the keys it publishes.
+type JWTAccessTokenGenerator struct {
+	srv      *Server
+	audience []string
+}
+
+// NewJWTAccessTokenGenerator returns a JWTAccessTokenGenerator for the Server, issuing tokens for the
+// default audience unless restricted to another one. The audience is required, since aud is a
+// required claim of JWT access tokens.
+func NewJWTAccessTokenGenerator(s *Server, audience []string) (*JWTAccessTokenGenerator, error) {
+	if len(audience) == 0 {
+		return nil, ErrMissingAudience
+	}
+
+	return &JWTAccessTokenGenerator{srv: s, audience: audience}, nil
+}
+
+// GenerateAccessToken generates a signed JWT describing the AccessToken. It fails unless both an
+// issuer and a KeyManager are configured in the Server.
+func (g JWTAccessTokenGenerator) GenerateAccessToken(at *AccessToken) (string, error) {
+	if g.srv.issuer == "" || g.srv.keyManager == nil {
+		return "", ErrServerError
+	}
+
+	claims := JWTAccessTokenClaims{
+		Claims: jose.Claims{
+			Issuer:    g.srv.issuer,
+			Subject:   at.Subject(),
+			Audience:  g.audience,
+			ExpiresAt: at.ExpiresAt().Unix(),
+			IssuedAt:  at.IssuedAt.Unix(),
+			ID:        uuid.NewV4().String(),
+		},
+		ClientID:     at.Client.ID.String(),
+		Scope:        strings.Join(at.Scopes, " "),
+		Confirmation: newConfirmation(at),
+		Actor:        at.Actor,
+	}
+
+	// Tokens restricted to an audience replace the default one.
+	if len(at.Audience) > 0 {
+		claims.Audience = at.Audience
+	}
+
+	key, err := g.srv.keyManager.SigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	return jose.Sign(key, JWTAccessTokenType, claims)
+}
+
+// ParseJWTAccessToken verifies a JWT access token signature using the key matching it's kid header in
+// the provided key set, and returns it's claims if it's not expired. Callers are responsible for
+// validating the issuer and audience.
+func ParseJWTAccessToken(token string, keys jose.JSONWebKeySet) (*JWTAccessTokenClaims, error) {
+	t, err := jose.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	key := keys.Key(t.Header.KeyID)
+	if key == nil {
+		return nil, ErrInvalidJWTAccessToken
+	}
+
+	if !strings.EqualFold(t.Header.Type, JWTAccessTokenType) && !strings.EqualFold(t.Header.Type, "application/"+JWTAccessTokenType) {
+		return nil, ErrInvalidJWTAccessToken
+	}
+
+	if err := t.Verify(key.Key); err != nil {
+		return nil, err
+	}
+
+	var claims JWTAccessTokenClaims
+	if err := t.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	if err := claims.Validate(time.Now(), 0); err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
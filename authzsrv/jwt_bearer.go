@@ -0,0 +1,142 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/gostack/oauth22/jose"
+	"github.com/gostack/option"
+)
+
+// GrantTypeJWTBearer is the grant type of the JWT bearer authorization grant, as defined by
+// https://tools.ietf.org/html/rfc7523#section-2.1
+const GrantTypeJWTBearer = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// TrustedIssuer is an identity provider trusted to issue JWT assertions about users.
+type TrustedIssuer struct {
+	// Issuer is the iss claim of the assertions issued by the identity provider.
+	Issuer string
+
+	// Keys and KeysURI are the public keys the identity provider signs it's assertions with.
+	// KeysURI is only used when Keys is empty.
+	Keys    jose.JSONWebKeySet
+	KeysURI string
+}
+
+// JWTBearer implements the OAuth2 JWT Bearer authorization grant, allowing clients to exchange a JWT
+// assertion issued by a trusted identity provider for an access token on behalf of the user it's
+// subject of, as described by https://tools.ietf.org/html/rfc7523#section-2.1
+//
+// The sub claim of the assertions is the username of the user, loaded using LoaderUserFromUsername.
+//
+// The Persistence provided to the Server must also implement ConsumerAssertionID.
+type JWTBearer struct {
+	// Issuers are the identity providers trusted to issue assertions.
+	Issuers []TrustedIssuer
+
+	// Audience are the values accepted in the aud claim of assertions, usually the issuer and token
+	// endpoint URL of the server.
+	Audience []string
+}
+
+// ResponseType simply registers a nil AuthorizationResponseType for JWTBearer
+func (s JWTBearer) ResponseType(_ Persistence) (option.String, AuthorizationResponseType) {
+	return option.NoneString(), nil
+}
+
+// GrantType registers the JWT bearer grant type for JWTBearer.
+func (s JWTBearer) GrantType(p Persistence) (option.String, TokenGrantType) {
+	consumer, ok := p.(ConsumerAssertionID)
+	if !ok {
+		log.Fatalf("%T must implement ConsumerAssertionID to support the JWTBearer strategy", p)
+	}
+
+	if len(s.Audience) == 0 {
+		log.Fatalf("JWTBearer requires the Audience of assertions to be configured")
+	}
+
+	gt := JWTBearerGrantType{
+		LoaderUserFromUsername: p,
+		assertions:             consumer,
+		issuers:                make(map[string]TrustedIssuer),
+		audience:               s.Audience,
+	}
+
+	for _, ti := range s.Issuers {
+		gt.issuers[ti.Issuer] = ti
+	}
+
+	return option.SomeString(GrantTypeJWTBearer), gt
+}
+
+// JWTBearerGrantType implements the TokenGrantType to allow for OAuth2's JWT bearer grant type.
+type JWTBearerGrantType struct {
+	LoaderUserFromUsername
+	assertions ConsumerAssertionID
+	issuers    map[string]TrustedIssuer
+	audience   []string
+}
+
+// IssueToken issues a new token on behalf of the user the assertion is subject of, as defined by
+// https://tools.ietf.org/html/rfc7523#section-3
+func (g JWTBearerGrantType) IssueToken(c *Client, params url.Values) (*AccessToken, error) {
+	assertion := params.Get("assertion")
+	if assertion == "" {
+		return nil, ErrInvalidRequest
+	}
+
+	t, err := jose.Parse(assertion)
+	if err != nil {
+		return nil, ErrInvalidGrant
+	}
+
+	var claims jose.Claims
+	if err := t.Claims(&claims); err != nil {
+		return nil, ErrInvalidGrant
+	}
+
+	ti, ok := g.issuers[claims.Issuer]
+	if !ok || claims.Subject == "" {
+		return nil, ErrInvalidGrant
+	}
+
+	// Assertions are signed with the private keys of the identity provider, so shared secrets are
+	// never accepted.
+	if t.Header.Algorithm == jose.HS256 || verifyAssertionSignature(t, ti.Keys, ti.KeysURI) != nil {
+		return nil, ErrInvalidGrant
+	}
+
+	if err := validateAssertion(claims, g.audience, g.assertions); err != nil {
+		if err == ErrServerError {
+			return nil, err
+		}
+		return nil, ErrInvalidGrant
+	}
+
+	u, err := g.LoadUserFromUsername(claims.Subject)
+	if err != nil {
+		return nil, ErrServerError
+	}
+	if u == nil {
+		return nil, ErrInvalidGrant
+	}
+
+	return NewAccessToken(c, u, strings.Fields(params.Get("scope")))
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gostack/oauth22/jose"
+)
+
+var ErrNoSigningKey = errors.New("no signing key available")
+
+// KeyManager is the interface for objects that manage the keys used by the server to sign tokens.
+type KeyManager interface {
+	// SigningKey returns the key currently used to sign new tokens.
+	SigningKey() (*jose.SigningKey, error)
+
+	// VerificationKeys returns the public keys that tokens in flight may be signed with.
+	VerificationKeys() ([]jose.JSONWebKey, error)
+}
+
+// retiredKey is a key no longer used for signing, but still published until tokens signed with it
+// expire.
+type retiredKey struct {
+	key       *jose.SigningKey
+	expiresAt time.Time
+}
+
+// RotatingKeyManager is an in-memory KeyManager supporting scheduled key rotation.
+//
+// Besides the active key, it holds the next key, which is published ahead of being used so
+// verifiers caching the key set know about it before the first token signed with it, and the
+// retired keys, which are published for a grace period so tokens signed with them remain valid.
+// The grace period should be at least as long as the lifetime of the tokens being signed.
+type RotatingKeyManager struct {
+	mu          sync.Mutex
+	active      *jose.SigningKey
+	next        *jose.SigningKey
+	retired     []retiredKey
+	gracePeriod time.Duration
+}
+
+// NewRotatingKeyManager creates a new RotatingKeyManager using the provided key as the active one.
+func NewRotatingKeyManager(active *jose.SigningKey, gracePeriod time.Duration) *RotatingKeyManager {
+	return &RotatingKeyManager{active: active, gracePeriod: gracePeriod}
+}
+
+// Rotate promotes the next key to active, retiring the currently active key for the grace period,
+// and stages the provided key as the next one. When there is no next key yet, the provided key is
+// only staged. Calling Rotate on a schedule with a freshly generated key rotates the keys without
+// invalidating tokens in flight.
+func (m *RotatingKeyManager) Rotate(next *jose.SigningKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.next != nil {
+		if m.active != nil {
+			m.retired = append(m.retired, retiredKey{m.active, time.Now().Add(m.gracePeriod)})
+		}
+		m.active = m.next
+	}
+
+	m.next = next
+}
+
+// SigningKey returns the active key.
+func (m *RotatingKeyManager) SigningKey() (*jose.SigningKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.active == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	return m.active, nil
+}
+
+// VerificationKeys returns the public keys of the active, next and retired keys still within their
+// grace period.
+func (m *RotatingKeyManager) VerificationKeys() ([]jose.JSONWebKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	retired := m.retired[:0]
+	for _, r := range m.retired {
+		if now.Before(r.expiresAt) {
+			retired = append(retired, r)
+		}
+	}
+	m.retired = retired
+
+	var keys []jose.JSONWebKey
+	for _, k := range []*jose.SigningKey{m.active, m.next} {
+		if k != nil {
+			keys = append(keys, jose.NewJSONWebKey(k))
+		}
+	}
+	for _, r := range m.retired {
+		keys = append(keys, jose.NewJSONWebKey(r.key))
+	}
+
+	return keys, nil
+}
+
+// jwksEndpointHandler publishes the server's verification keys, as defined by
+// https://tools.ietf.org/html/rfc7517#section-5
+func (s *Server) jwksEndpointHandler(w http.ResponseWriter, req *http.Request) {
+	if s.keyManager == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	keys, err := s.keyManager.VerificationKeys()
+	if err != nil {
+		respondError(w, ErrServerError)
+		return
+	}
+
+	respondJSON(w, jose.JSONWebKeySet{Keys: keys})
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gostack/oauth22/jose"
+)
+
+// ServerMetadata describes the server configuration to clients, as defined by
+// https://tools.ietf.org/html/rfc8414#section-2
+type ServerMetadata struct {
+	Issuer                                     string   `json:"issuer"`
+	AuthorizationEndpoint                      string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                              string   `json:"token_endpoint"`
+	JWKSURI                                    string   `json:"jwks_uri,omitempty"`
+	ScopesSupported                            []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported                     []string `json:"response_types_supported"`
+	GrantTypesSupported                        []string `json:"grant_types_supported"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported"`
+	TokenEndpointAuthSigningAlgValuesSupported []string `json:"token_endpoint_auth_signing_alg_values_supported,omitempty"`
+	RevocationEndpoint                         string   `json:"revocation_endpoint"`
+	RevocationEndpointAuthMethodsSupported     []string `json:"revocation_endpoint_auth_methods_supported"`
+	IntrospectionEndpoint                      string   `json:"introspection_endpoint"`
+	IntrospectionEndpointAuthMethodsSupported  []string `json:"introspection_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported,omitempty"`
+	TLSClientCertificateBoundAccessTokens      bool     `json:"tls_client_certificate_bound_access_tokens"`
+	DeviceAuthorizationEndpoint                string   `json:"device_authorization_endpoint,omitempty"`
+	SubjectTypesSupported                      []string `json:"subject_types_supported,omitempty"`
+	IDTokenSigningAlgValuesSupported           []string `json:"id_token_signing_alg_values_supported,omitempty"`
+	UserInfoEndpoint                           string   `json:"userinfo_endpoint,omitempty"`
+}
+
+// Metadata builds the ServerMetadata from the server configuration, so it always reflects the
+// registered strategies. The issuer is used as the base URL of every endpoint.
+func (s *Server) Metadata(issuer string) *ServerMetadata {
+	authMethods := s.tokenEndpointAuthMethods()
+
+	m := ServerMetadata{
+		Issuer:                                    issuer,
+		TokenEndpoint:                             issuer + TokenEndpointPath,
+		ResponseTypesSupported:                    []string{},
+		GrantTypesSupported:                       []string{},
+		TokenEndpointAuthMethodsSupported:         authMethods,
+		RevocationEndpoint:                        issuer + RevocationEndpointPath,
+		RevocationEndpointAuthMethodsSupported:    authMethods,
+		IntrospectionEndpoint:                     issuer + IntrospectionEndpointPath,
+		IntrospectionEndpointAuthMethodsSupported: withoutAuthMethod(authMethods, AuthMethodNone),
+
+		// Tokens of clients registered for it are always bound to their certificate, as defined by
+		// https://tools.ietf.org/html/rfc8705#section-3.3
+		TLSClientCertificateBoundAccessTokens: true,
+	}
+
+	if len(s.scopes) > 0 {
+		m.ScopesSupported = s.scopeNames()
+	}
+
+	for name := range s.responseTypes {
+		if _, ok := s.responseType(name); ok {
+			m.ResponseTypesSupported = append(m.ResponseTypesSupported, name)
+		}
+	}
+	sort.Strings(m.ResponseTypesSupported)
+
+	for name := range s.grantTypes {
+		m.GrantTypesSupported = append(m.GrantTypesSupported, name)
+	}
+	// The implicit grant is used at the authorization endpoint alone, so it's not registered as a
+	// grant type, but it's still listed as defined by https://tools.ietf.org/html/rfc8414#section-2
+	if _, ok := s.responseType(ResponseTypeToken); ok {
+		m.GrantTypesSupported = append(m.GrantTypesSupported, "implicit")
+	}
+	sort.Strings(m.GrantTypesSupported)
+
+	if _, ok := s.clientAuthenticators[AuthMethodClientSecretJWT]; ok {
+		m.TokenEndpointAuthSigningAlgValuesSupported = append(m.TokenEndpointAuthSigningAlgValuesSupported, jose.HS256)
+	}
+	if _, ok := s.clientAuthenticators[AuthMethodPrivateKeyJWT]; ok {
+		m.TokenEndpointAuthSigningAlgValuesSupported = append(m.TokenEndpointAuthSigningAlgValuesSupported, jose.RS256, jose.ES256, jose.EdDSA)
+	}
+
+	if len(m.ResponseTypesSupported) > 0 {
+		m.AuthorizationEndpoint = issuer + AuthorizationEndpointPath
+	}
+
+	if _, ok := s.grantTypes[GrantTypeDeviceCode]; ok {
+		m.DeviceAuthorizationEndpoint = issuer + DeviceAuthorizationEndpointPath
+	}
+
+	if s.keyManager != nil {
+		m.JWKSURI = issuer + JWKSEndpointPath
+	}
+
+	// ID tokens are issued in the authorization code flow, signed with the server's signing key, as
+	// described by https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+	if _, ok := s.responseTypes["code"]; ok && s.keyManager != nil {
+		if key, err := s.keyManager.SigningKey(); err == nil {
+			m.SubjectTypesSupported = []string{"public"}
+			m.IDTokenSigningAlgValuesSupported = []string{key.Algorithm}
+			m.UserInfoEndpoint = issuer + UserInfoEndpointPath
+		}
+	}
+
+	if rt, ok := s.responseTypes["code"].(AuthorizationCodeResponseType); ok {
+		m.CodeChallengeMethodsSupported = []string{CodeChallengeS256}
+		if !rt.forbidPlainCodeChallenge {
+			m.CodeChallengeMethodsSupported = append(m.CodeChallengeMethodsSupported, CodeChallengePlain)
+		}
+	}
+
+	return &m
+}
+
+// tokenEndpointAuthMethods returns the names of the registered client authentication methods.
+func (s *Server) tokenEndpointAuthMethods() []string {
+	methods := make([]string, 0, len(s.clientAuthenticators))
+	for name := range s.clientAuthenticators {
+		methods = append(methods, name)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// withoutAuthMethod returns the methods except the provided one.
+func withoutAuthMethod(methods []string, method string) []string {
+	filtered := make([]string, 0, len(methods))
+	for _, m := range methods {
+		if m != method {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+// metadataEndpointHandler publishes the server metadata, as defined by
+// https://tools.ietf.org/html/rfc8414#section-3
+//
+// The published issuer must be identical to the one the server is identified by, so metadata is
+// only published once an issuer is configured with SetIssuer, never derived from the request.
+func (s *Server) metadataEndpointHandler(w http.ResponseWriter, req *http.Request) {
+	if s.issuer == "" {
+		http.NotFound(w, req)
+		return
+	}
+
+	respondJSON(w, s.Metadata(s.issuer))
+}
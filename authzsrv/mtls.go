@@ -0,0 +1,129 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+)
+
+// CertificateThumbprint returns the x5t#S256 thumbprint of the certificate, which is the base64url
+// encoded SHA-256 hash of it's DER encoding.
+func CertificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// peerCertificate returns the certificate presented by the client in the TLS connection, if any.
+func peerCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+
+	return req.TLS.PeerCertificates[0]
+}
+
+// clientCertificateAuthenticator authenticates clients using the certificate presented in the
+// mutual TLS connection, either issued by a trusted CA (tls_client_auth) or self-signed
+// (self_signed_tls_client_auth), as defined by https://tools.ietf.org/html/rfc8705#section-2
+type clientCertificateAuthenticator struct {
+	srv    *Server
+	method string
+}
+
+func (ca clientCertificateAuthenticator) Method() string {
+	return ca.method
+}
+
+// Detect only considers requests without other credentials, since the certificate may be presented
+// by clients authenticating with a different method. Both methods are told apart by whether the
+// TLS layer verified the certificate chain, so servers accepting tls_client_auth must verify the
+// certificates of clients (e.g. with tls.VerifyClientCertIfGiven).
+func (ca clientCertificateAuthenticator) Detect(req *http.Request) bool {
+	if peerCertificate(req) == nil || req.Header.Get("Authorization") != "" {
+		return false
+	}
+	if req.PostFormValue("client_secret") != "" || req.PostFormValue("client_assertion") != "" {
+		return false
+	}
+
+	return (len(req.TLS.VerifiedChains) > 0) == (ca.method == AuthMethodTLSClientAuth)
+}
+
+func (ca clientCertificateAuthenticator) AuthenticateClient(req *http.Request) (*Client, error) {
+	c, err := ca.srv.loadClient(req.PostFormValue("client_id"))
+	if err != nil {
+		return nil, err
+	}
+
+	cert := peerCertificate(req)
+
+	// The chain was already verified against the trusted CAs by the TLS layer, so it's only
+	// left to check that the certificate is the one registered for the client.
+	if ca.method == AuthMethodTLSClientAuth {
+		if !matchesTLSClientAuth(c, cert) {
+			return nil, ErrInvalidClient
+		}
+		return c, nil
+	}
+
+	for _, k := range c.JWKS.Keys {
+		if len(k.Certificates) > 0 && bytes.Equal(k.Certificates[0].Raw, cert.Raw) {
+			return c, nil
+		}
+	}
+
+	return nil, ErrInvalidClient
+}
+
+// matchesTLSClientAuth returns whether the certificate matches the one registered for the client, as
+// defined by https://tools.ietf.org/html/rfc8705#section-2.1.2
+func matchesTLSClientAuth(c *Client, cert *x509.Certificate) bool {
+	switch {
+	case c.TLSClientAuthSubjectDN != "":
+		return cert.Subject.String() == c.TLSClientAuthSubjectDN
+	case c.TLSClientAuthSANDNS != "":
+		for _, name := range cert.DNSNames {
+			if name == c.TLSClientAuthSANDNS {
+				return true
+			}
+		}
+	case c.TLSClientAuthSANURI != "":
+		for _, uri := range cert.URIs {
+			if uri.String() == c.TLSClientAuthSANURI {
+				return true
+			}
+		}
+	case c.TLSClientAuthSANIP != "":
+		for _, ip := range cert.IPAddresses {
+			if ip.String() == c.TLSClientAuthSANIP {
+				return true
+			}
+		}
+	case c.TLSClientAuthSANEmail != "":
+		for _, email := range cert.EmailAddresses {
+			if email == c.TLSClientAuthSANEmail {
+				return true
+			}
+		}
+	}
+
+	return false
+}
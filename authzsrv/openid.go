@@ -0,0 +1,123 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/gostack/oauth22/jose"
+)
+
+// ScopeOpenID is the scope requesting an OpenID Connect authentication, as defined by
+// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+//
+// When using the scope registry, it must be registered for ID tokens to be issued. Requests for it
+// are rejected unless the Server was configured with both an issuer and a KeyManager.
+const ScopeOpenID = "openid"
+
+// DefaultIDTokenLifetime is the lifetime of issued ID tokens.
+const DefaultIDTokenLifetime = 1 * time.Hour
+
+// IDTokenClaims are the claims of OpenID Connect ID tokens, as defined by
+// https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+type IDTokenClaims struct {
+	jose.Claims
+	AuthTime        int64  `json:"auth_time,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+	AccessTokenHash string `json:"at_hash,omitempty"`
+	CodeHash        string `json:"c_hash,omitempty"`
+}
+
+// openIDEnabled returns whether the Server is able to issue ID tokens, which requires a configured
+// issuer, since the iss claim can't be derived from the request, and a KeyManager to sign them.
+func (s *Server) openIDEnabled() bool {
+	return s.issuer != "" && s.keyManager != nil
+}
+
+// generateIDToken generates the ID token issued along with the AccessToken in the authorization code
+// flow, signed with the server's signing key, as defined by
+// https://openid.net/specs/openid-connect-core-1_0.html#TokenResponse
+func (s *Server) generateIDToken(at *AccessToken, code string) (string, error) {
+	if !s.openIDEnabled() {
+		return "", ErrServerError
+	}
+
+	key, err := s.keyManager.SigningKey()
+	if err != nil {
+		return "", ErrServerError
+	}
+
+	now := time.Now()
+	claims := IDTokenClaims{
+		Claims: jose.Claims{
+			Issuer:    s.issuer,
+			Subject:   at.Subject(),
+			Audience:  jose.Audience{at.Client.ID.String()},
+			ExpiresAt: now.Add(DefaultIDTokenLifetime).Unix(),
+			IssuedAt:  now.Unix(),
+			ID:        uuid.NewV4().String(),
+		},
+		Nonce: at.Nonce,
+	}
+
+	if !at.AuthTime.IsZero() {
+		claims.AuthTime = at.AuthTime.Unix()
+	}
+
+	if claims.AccessTokenHash, err = tokenHash(key.Algorithm, at.Token); err != nil {
+		return "", ErrServerError
+	}
+	if code != "" {
+		if claims.CodeHash, err = tokenHash(key.Algorithm, code); err != nil {
+			return "", ErrServerError
+		}
+	}
+
+	t, err := jose.Sign(key, "JWT", claims)
+	if err != nil {
+		return "", ErrServerError
+	}
+
+	return t, nil
+}
+
+// tokenHash returns the at_hash or c_hash of the token for ID tokens signed with the algorithm, which
+// is the left-most half of the token hash, as defined by
+// https://openid.net/specs/openid-connect-core-1_0.html#CodeIDToken
+//
+// The hash is the one used by the algorithm, which is SHA-512 for EdDSA with Ed25519 keys.
+func tokenHash(alg, token string) (string, error) {
+	var sum []byte
+
+	switch alg {
+	case jose.HS256, jose.RS256, jose.ES256:
+		h := sha256.Sum256([]byte(token))
+		sum = h[:]
+	case jose.EdDSA:
+		h := sha512.Sum512([]byte(token))
+		sum = h[:]
+	default:
+		return "", jose.ErrUnsupportedAlgorithm
+	}
+
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
+}
@@ -18,6 +18,8 @@ package authzsrv
 
 import (
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/satori/go.uuid"
 )
@@ -43,11 +45,151 @@ type LoaderUserFromUsername interface {
 	LoadUserFromUsername(username string) (*User, error)
 }
 
+// SaverAccessToken is the interface for objects that knows how to persist an AccessToken. When the
+// Persistence provided to the Server implements it, every issued AccessToken is saved.
+type SaverAccessToken interface {
+	SaveAccessToken(at *AccessToken) error
+}
+
+// LoaderAccessTokenFromToken is the interface for objects that knows how to load an AccessToken
+// from it's token.
+type LoaderAccessTokenFromToken interface {
+	LoadAccessTokenFromToken(token string) (*AccessToken, error)
+}
+
+// RevokerAccessToken is the interface for objects that knows how to revoke an AccessToken, so it
+// can no longer be loaded.
+type RevokerAccessToken interface {
+	RevokeAccessToken(token string) error
+}
+
+// RevokerAccessTokenFamily is the interface for objects that knows how to revoke all access tokens
+// issued along with refresh tokens of the same family.
+type RevokerAccessTokenFamily interface {
+	RevokeAccessTokenFamily(familyID uuid.UUID) error
+}
+
+// SaverUser is the interface for objects that knows how to persist changes to a User, such as it's
+// password hash being upgraded.
+type SaverUser interface {
+	SaveUser(u *User) error
+}
+
+// ConsumerAssertionID is the interface for objects that knows how to record the jti of JWT
+// assertions, preventing them from being replayed. ConsumeAssertionID returns false if the jti was
+// already used by the same issuer. Records only need to be kept until the provided expiration time.
+type ConsumerAssertionID interface {
+	ConsumeAssertionID(issuer, jti string, expiresAt time.Time) (bool, error)
+}
+
+// ClaimsProvider is the interface for objects that knows how to provide the OpenID Connect claims
+// of a User, returning nil if the user has no claims besides it's subject. The userinfo endpoint only
+// discloses the claims allowed by the scopes granted to the token.
+type ClaimsProvider interface {
+	LoadUserClaims(u *User) (*UserClaims, error)
+}
+
+// AuthorizationCodePersistence is the interface that persistence layers need to implement in order
+// to support the authorization code grant type.
+type AuthorizationCodePersistence interface {
+	SaverAuthorizationCode
+	ConsumerAuthorizationCode
+}
+
+// SaverAuthorizationCode is the interface for objects that knows how to persist a UserAuthorizationCode.
+type SaverAuthorizationCode interface {
+	SaveAuthorizationCode(ac *UserAuthorizationCode) error
+}
+
+// ConsumerAuthorizationCode is the interface for objects that knows how to load a UserAuthorizationCode
+// from it's code. Since codes are single use, loading it must also atomically remove it, so that
+// subsequent calls with the same code don't return anything.
+type ConsumerAuthorizationCode interface {
+	ConsumeAuthorizationCode(code string) (*UserAuthorizationCode, error)
+}
+
+// RefreshTokenPersistence is the interface that persistence layers need to implement in order to
+// support the refresh token grant type.
+type RefreshTokenPersistence interface {
+	SaverRefreshToken
+	ConsumerRefreshToken
+	LoaderRefreshTokenFromToken
+	RevokerRefreshTokenFamily
+}
+
+// SaverRefreshToken is the interface for objects that knows how to persist a UserRefreshToken.
+type SaverRefreshToken interface {
+	SaveRefreshToken(rt *UserRefreshToken) error
+}
+
+// ConsumerRefreshToken is the interface for objects that knows how to load a UserRefreshToken from
+// it's token. Loading it must also atomically mark it as used, returning the token as it was before,
+// so that concurrent uses of the same token are detected.
+type ConsumerRefreshToken interface {
+	ConsumeRefreshToken(token string) (*UserRefreshToken, error)
+}
+
+// LoaderRefreshTokenFromToken is the interface for objects that knows how to load a
+// UserRefreshToken from it's token, without marking it as used.
+type LoaderRefreshTokenFromToken interface {
+	LoadRefreshTokenFromToken(token string) (*UserRefreshToken, error)
+}
+
+// RevokerRefreshTokenFamily is the interface for objects that knows how to revoke all refresh
+// tokens that belong to the same family.
+type RevokerRefreshTokenFamily interface {
+	RevokeRefreshTokenFamily(familyID uuid.UUID) error
+}
+
+// DeviceCodePersistence is the interface that persistence layers need to implement in order to
+// support the device code grant type.
+type DeviceCodePersistence interface {
+	SaverDeviceCode
+	LoaderDeviceCodeFromUserCode
+	ConsumerDeviceCode
+	CompleterDeviceCode
+}
+
+// SaverDeviceCode is the interface for objects that knows how to persist a UserDeviceCode when
+// issued.
+type SaverDeviceCode interface {
+	SaveDeviceCode(dc *UserDeviceCode) error
+}
+
+// LoaderDeviceCodeFromUserCode is the interface for objects that knows how to load a UserDeviceCode
+// from it's user code.
+type LoaderDeviceCodeFromUserCode interface {
+	LoadDeviceCodeFromUserCode(userCode string) (*UserDeviceCode, error)
+}
+
+// ConsumerDeviceCode is the interface for objects that knows how to load a UserDeviceCode from it's
+// device code when the client polls for it. Loading it must also atomically record the time of the
+// poll, returning the device code as it was before. Once approved or denied, the device code must
+// be removed, so that subsequent calls with the same code don't return anything.
+type ConsumerDeviceCode interface {
+	ConsumeDeviceCode(deviceCode string) (*UserDeviceCode, error)
+}
+
+// CompleterDeviceCode is the interface for objects that knows how to record the user's decision on
+// a UserDeviceCode, setting either it's User or Denied. It must atomically update only those fields
+// of a device code that's still pending, since the client keeps polling meanwhile, and report
+// whether it was.
+type CompleterDeviceCode interface {
+	CompleteDeviceCode(deviceCode string, u *User, denied bool) (bool, error)
+}
+
 // InMemoryPersistence implements the Persistence interface using an in-memory persistence scheme.
 // This is mainly for test purpose and should not be used in production.
 type InMemoryPersistence struct {
+	mu      sync.Mutex
 	clients map[uuid.UUID]*Client
 	users   map[string]*User
+	tokens  map[string]*AccessToken
+	codes   map[string]*UserAuthorizationCode
+	refresh map[string]*UserRefreshToken
+	jtis    map[string]time.Time
+	devices map[string]*UserDeviceCode
+	claims  map[string]*UserClaims
 }
 
 // NewInMemoryPersistence creates a new InMemoryPersistence and returns a pointer to it.
@@ -55,11 +197,20 @@ func NewInMemoryPersistence() *InMemoryPersistence {
 	return &InMemoryPersistence{
 		clients: make(map[uuid.UUID]*Client),
 		users:   make(map[string]*User),
+		tokens:  make(map[string]*AccessToken),
+		codes:   make(map[string]*UserAuthorizationCode),
+		refresh: make(map[string]*UserRefreshToken),
+		jtis:    make(map[string]time.Time),
+		devices: make(map[string]*UserDeviceCode),
+		claims:  make(map[string]*UserClaims),
 	}
 }
 
 // LoadClientFromID returns a client matching the provided id, otherwise returns an error.
-func (p InMemoryPersistence) LoadClientFromID(id uuid.UUID) (*Client, error) {
+func (p *InMemoryPersistence) LoadClientFromID(id uuid.UUID) (*Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	c, ok := p.clients[id]
 	if !ok {
 		return nil, nil
@@ -69,7 +220,10 @@ func (p InMemoryPersistence) LoadClientFromID(id uuid.UUID) (*Client, error) {
 }
 
 // LoadUserFromUsername returns a user matching the provided username, otherwise returns an error.
-func (p InMemoryPersistence) LoadUserFromUsername(username string) (*User, error) {
+func (p *InMemoryPersistence) LoadUserFromUsername(username string) (*User, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	u, ok := p.users[username]
 	if !ok {
 		return nil, nil
@@ -78,14 +232,253 @@ func (p InMemoryPersistence) LoadUserFromUsername(username string) (*User, error
 	return u, nil
 }
 
+// SaveUser persists a user.
+func (p *InMemoryPersistence) SaveUser(u *User) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.users[u.Username] = u
+	return nil
+}
+
+// SaveAccessToken persists an access token.
+func (p *InMemoryPersistence) SaveAccessToken(at *AccessToken) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tokens[at.Token] = at
+	return nil
+}
+
+// LoadAccessTokenFromToken returns the access token matching the provided token.
+func (p *InMemoryPersistence) LoadAccessTokenFromToken(token string) (*AccessToken, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	at, ok := p.tokens[token]
+	if !ok {
+		return nil, nil
+	}
+
+	return at, nil
+}
+
+// LoadUserClaims returns the claims registered for the user.
+func (p *InMemoryPersistence) LoadUserClaims(u *User) (*UserClaims, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, ok := p.claims[u.Username]
+	if !ok {
+		return nil, nil
+	}
+
+	return c, nil
+}
+
+// RevokeAccessToken removes the access token matching the provided token.
+func (p *InMemoryPersistence) RevokeAccessToken(token string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.tokens, token)
+	return nil
+}
+
+// RevokeAccessTokenFamily removes all access tokens issued with the provided refresh token family.
+func (p *InMemoryPersistence) RevokeAccessTokenFamily(familyID uuid.UUID) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for token, at := range p.tokens {
+		if uuid.Equal(at.FamilyID, familyID) {
+			delete(p.tokens, token)
+		}
+	}
+
+	return nil
+}
+
+// ConsumeAssertionID records the jti for the issuer, returning false if it was already recorded.
+func (p *InMemoryPersistence) ConsumeAssertionID(issuer, jti string, expiresAt time.Time) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for k, exp := range p.jtis {
+		if now.After(exp) {
+			delete(p.jtis, k)
+		}
+	}
+
+	key := issuer + " " + jti
+	if _, ok := p.jtis[key]; ok {
+		return false, nil
+	}
+
+	p.jtis[key] = expiresAt
+	return true, nil
+}
+
+// SaveAuthorizationCode persists an authorization code.
+func (p *InMemoryPersistence) SaveAuthorizationCode(ac *UserAuthorizationCode) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.codes[ac.Code] = ac
+	return nil
+}
+
+// ConsumeAuthorizationCode returns the authorization code matching the provided code and removes
+// it, so it can't be used again.
+func (p *InMemoryPersistence) ConsumeAuthorizationCode(code string) (*UserAuthorizationCode, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ac, ok := p.codes[code]
+	if !ok {
+		return nil, nil
+	}
+
+	delete(p.codes, code)
+	return ac, nil
+}
+
+// SaveRefreshToken persists a refresh token.
+func (p *InMemoryPersistence) SaveRefreshToken(rt *UserRefreshToken) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.refresh[rt.Token] = rt
+	return nil
+}
+
+// ConsumeRefreshToken returns the refresh token matching the provided token and marks it as used.
+func (p *InMemoryPersistence) ConsumeRefreshToken(token string) (*UserRefreshToken, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rt, ok := p.refresh[token]
+	if !ok {
+		return nil, nil
+	}
+
+	prev := *rt
+	rt.Used = true
+	return &prev, nil
+}
+
+// LoadRefreshTokenFromToken returns the refresh token matching the provided token.
+func (p *InMemoryPersistence) LoadRefreshTokenFromToken(token string) (*UserRefreshToken, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rt, ok := p.refresh[token]
+	if !ok {
+		return nil, nil
+	}
+
+	return rt, nil
+}
+
+// RevokeRefreshTokenFamily revokes all refresh tokens belonging to the provided family.
+func (p *InMemoryPersistence) RevokeRefreshTokenFamily(familyID uuid.UUID) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, rt := range p.refresh {
+		if uuid.Equal(rt.FamilyID, familyID) {
+			rt.Revoked = true
+		}
+	}
+
+	return nil
+}
+
+// SaveDeviceCode persists a device code.
+func (p *InMemoryPersistence) SaveDeviceCode(dc *UserDeviceCode) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	saved := *dc
+	p.devices[dc.DeviceCode] = &saved
+	return nil
+}
+
+// LoadDeviceCodeFromUserCode returns the device code matching the provided user code.
+func (p *InMemoryPersistence) LoadDeviceCodeFromUserCode(userCode string) (*UserDeviceCode, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, dc := range p.devices {
+		if dc.UserCode == userCode {
+			loaded := *dc
+			return &loaded, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// ConsumeDeviceCode returns the device code matching the provided device code, recording the poll
+// and removing it once approved or denied.
+func (p *InMemoryPersistence) ConsumeDeviceCode(deviceCode string) (*UserDeviceCode, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dc, ok := p.devices[deviceCode]
+	if !ok {
+		return nil, nil
+	}
+
+	prev := *dc
+	if prev.Pending() {
+		dc.LastPolledAt = time.Now()
+	} else {
+		delete(p.devices, deviceCode)
+	}
+
+	return &prev, nil
+}
+
+// CompleteDeviceCode records the user's decision on the device code matching the provided device
+// code, as long as it's still pending.
+func (p *InMemoryPersistence) CompleteDeviceCode(deviceCode string, u *User, denied bool) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dc, ok := p.devices[deviceCode]
+	if !ok || !dc.Pending() {
+		return false, nil
+	}
+
+	dc.User = u
+	dc.Denied = denied
+	return true, nil
+}
+
 // AUXILIARY METHODS BELOW, NOT PART OF THE INTERFACE
 
 // RegisterClient persists a client
 func (p *InMemoryPersistence) RegisterClient(c *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.clients[c.ID] = c
 }
 
 // RegisterUser perstists a user
 func (p *InMemoryPersistence) RegisterUser(u *User) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.users[u.Username] = u
 }
+
+// RegisterUserClaims persists the claims of a user
+func (p *InMemoryPersistence) RegisterUserClaims(u *User, c *UserClaims) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.claims[u.Username] = c
+}
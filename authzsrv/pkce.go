@@ -0,0 +1,67 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+
+	"github.com/gostack/oauth22/security"
+)
+
+// Code challenge methods defined by https://tools.ietf.org/html/rfc7636#section-4.2
+const (
+	CodeChallengePlain = "plain"
+	CodeChallengeS256  = "S256"
+)
+
+// validCodeVerifier returns whether the string is a syntactically valid code verifier or challenge,
+// as defined by https://tools.ietf.org/html/rfc7636#section-4.1
+func validCodeVerifier(v string) bool {
+	if len(v) < 43 || len(v) > 128 {
+		return false
+	}
+
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// VerifyCodeChallenge verifies that the code verifier matches the code challenge using the provided
+// method, as defined by https://tools.ietf.org/html/rfc7636#section-4.6
+func VerifyCodeChallenge(challenge, method, verifier string) bool {
+	if !validCodeVerifier(verifier) {
+		return false
+	}
+
+	switch method {
+	case CodeChallengePlain:
+		return security.Compare([]byte(challenge), []byte(verifier))
+	case CodeChallengeS256:
+		sum := sha256.Sum256([]byte(verifier))
+		return security.Compare([]byte(challenge), []byte(base64.RawURLEncoding.EncodeToString(sum[:])))
+	default:
+		return false
+	}
+}
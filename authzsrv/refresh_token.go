@@ -0,0 +1,216 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gostack/option"
+	"github.com/satori/go.uuid"
+)
+
+// DefaultRefreshTokenLifetime is the lifetime of refresh tokens when none is configured in the
+// RefreshToken strategy.
+const DefaultRefreshTokenLifetime = (24 * time.Hour) * 30
+
+// RefreshToken implement the standard OAuth2 Refresh Token grant type as described by
+// https://tools.ietf.org/html/rfc6749#section-6
+//
+// Once registered, refresh tokens are issued along with every access token issued on behalf of a
+// user. Refresh tokens are rotated on each use, and replaying one that was already used revokes
+// every refresh token derived from the same original grant.
+//
+// The Persistence provided to the Server must also implement RefreshTokenPersistence.
+type RefreshToken struct {
+	// Lifetime is the duration for which issued refresh tokens can be used.
+	Lifetime time.Duration
+}
+
+// ResponseType simply registers a nil AuthorizationResponseType for RefreshToken
+func (s RefreshToken) ResponseType(_ Persistence) (option.String, AuthorizationResponseType) {
+	return option.NoneString(), nil
+}
+
+// GrantType registers the refresh_token grant type for RefreshToken.
+func (s RefreshToken) GrantType(p Persistence) (option.String, TokenGrantType) {
+	rp, ok := p.(RefreshTokenPersistence)
+	if !ok {
+		log.Fatalf("%T must implement RefreshTokenPersistence to support the RefreshToken strategy", p)
+	}
+
+	lifetime := s.Lifetime
+	if lifetime == 0 {
+		lifetime = DefaultRefreshTokenLifetime
+	}
+
+	gt := RefreshTokenGrantType{RefreshTokenPersistence: rp, lifetime: lifetime}
+	gt.accessTokens, _ = p.(RevokerAccessTokenFamily)
+
+	return option.SomeString("refresh_token"), gt
+}
+
+// RefreshTokenGrantType implements the TokenGrantType to allow for OAuth2's refresh_token grant
+// type.
+type RefreshTokenGrantType struct {
+	RefreshTokenPersistence
+	lifetime     time.Duration
+	accessTokens RevokerAccessTokenFamily
+}
+
+// IssueRefreshToken issues a refresh token, starting a new token family, for the provided access
+// token.
+func (g RefreshTokenGrantType) IssueRefreshToken(at *AccessToken) error {
+	return g.issueRefreshToken(at, uuid.NewV4(), at.Scopes)
+}
+
+// issueRefreshToken issues a refresh token in the provided family. The scopes are passed explicitly
+// since a rotated refresh token keeps the scope of the original grant, even when the access token
+// was issued with a narrower one.
+func (g RefreshTokenGrantType) issueRefreshToken(at *AccessToken, familyID uuid.UUID, scopes []string) error {
+	rt, err := NewUserRefreshToken(at, familyID, g.lifetime)
+	if err != nil {
+		return err
+	}
+	rt.Scopes = scopes
+
+	if err := g.SaveRefreshToken(rt); err != nil {
+		return ErrServerError
+	}
+
+	at.RefreshToken = rt.Token
+	at.FamilyID = familyID
+	return nil
+}
+
+// AllowsPublicClients allows public clients to refresh their tokens, relying on the rotation of
+// refresh tokens to detect their theft.
+func (g RefreshTokenGrantType) AllowsPublicClients() bool {
+	return true
+}
+
+// RevokeFamily revokes all refresh tokens from the provided family, along with the access tokens
+// issued with them when the persistence supports it.
+func (g RefreshTokenGrantType) RevokeFamily(familyID uuid.UUID) error {
+	if err := g.RevokeRefreshTokenFamily(familyID); err != nil {
+		return err
+	}
+
+	if g.accessTokens != nil {
+		return g.accessTokens.RevokeAccessTokenFamily(familyID)
+	}
+
+	return nil
+}
+
+// IssueToken issues a new token for the requesting client in exchange of a refresh token, as
+// defined by the refresh token grant type. The refresh token is only loaded here, and replaced by a
+// new one by CommitGrant once the server accepted the issued token.
+func (g RefreshTokenGrantType) IssueToken(c *Client, params url.Values) (*AccessToken, error) {
+	token := params.Get("refresh_token")
+	if token == "" {
+		return nil, ErrInvalidRequest
+	}
+
+	rt, err := g.LoadRefreshTokenFromToken(token)
+	if err != nil {
+		return nil, ErrServerError
+	}
+	if err := g.validateRefreshToken(c, rt); err != nil {
+		return nil, err
+	}
+
+	scopes := rt.Scopes
+	if scope := params.Get("scope"); scope != "" {
+		scopes = strings.Fields(scope)
+		if !containsAll(rt.Scopes, scopes) {
+			return nil, ErrInvalidScope
+		}
+	}
+
+	at, err := NewAccessToken(c, rt.User, scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	// The token joins the family before it's saved, so reusing the refresh token revokes it too.
+	at.FamilyID = rt.FamilyID
+	return at, nil
+}
+
+// CommitGrant consumes the refresh token used to issue the access token, replacing it with a new
+// one from the same family.
+func (g RefreshTokenGrantType) CommitGrant(at *AccessToken, params url.Values) error {
+	rt, err := g.ConsumeRefreshToken(params.Get("refresh_token"))
+	if err != nil {
+		return ErrServerError
+	}
+
+	// The token is validated again, as it may have been used or revoked since it was loaded.
+	if err := g.validateRefreshToken(at.Client, rt); err != nil {
+		return err
+	}
+
+	return g.issueRefreshToken(at, rt.FamilyID, rt.Scopes)
+}
+
+// validateRefreshToken validates the refresh token can be used by the requesting client.
+func (g RefreshTokenGrantType) validateRefreshToken(c *Client, rt *UserRefreshToken) error {
+	if rt == nil || rt.Revoked || rt.Expired() {
+		return ErrInvalidGrant
+	}
+
+	if !uuid.Equal(rt.Client.ID, c.ID) {
+		return ErrInvalidGrant
+	}
+
+	// A refresh token that was already used has likely been stolen, and since there is no way to
+	// know whether the legitimate client or the attacker is using it, the whole family is revoked.
+	// https://tools.ietf.org/html/rfc6819#section-5.2.2.3
+	if rt.Used {
+		if err := g.RevokeFamily(rt.FamilyID); err != nil {
+			return ErrServerError
+		}
+		return ErrInvalidGrant
+	}
+
+	return nil
+}
+
+// containsAll returns whether all elements of subset are present in set.
+func containsAll(set, subset []string) bool {
+	for _, s := range subset {
+		if !contains(set, s) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// contains returns whether the element is present in set.
+func contains(set []string, element string) bool {
+	for _, e := range set {
+		if e == element {
+			return true
+		}
+	}
+
+	return false
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package authzsrv
 
 import (
+	"log"
 	"net/url"
 	"strings"
 
@@ -26,7 +27,13 @@ import (
 
 // ResourceOwnerPasswordCredentials implement the standard OAuth2 Resource Owner Password
 // Credentials grant type as described by https://tools.ietf.org/html/rfc6749#section-4.3
-type ResourceOwnerPasswordCredentials struct{}
+//
+// When the Persistence provided to the Server implements SaverUser, password hashes produced by
+// another algorithm or with other parameters than the preferred ones are upgraded on login.
+type ResourceOwnerPasswordCredentials struct {
+	// Hashers verifies user passwords, defaulting to security.DefaultPasswordHashers.
+	Hashers security.PasswordHashers
+}
 
 // ResponseType simply registers a nil AuthorizationResponseType for
 // ResourceOwnerPasswordCredentials
@@ -36,13 +43,35 @@ func (c ResourceOwnerPasswordCredentials) ResponseType(p Persistence) (option.St
 
 // GrantType register the client_credentials grant type for ResourceOwnerPasswordCredentials.
 func (s ResourceOwnerPasswordCredentials) GrantType(p Persistence) (option.String, TokenGrantType) {
-	return option.SomeString("password"), ResourceOwnerPasswordCredentialsGrantType{p}
+	hashers := s.Hashers
+	if len(hashers) == 0 {
+		hashers = security.DefaultPasswordHashers
+	}
+
+	// Passwords of unknown users are verified against a hash of a random password, so the response
+	// takes as long as for known users and doesn't disclose which usernames exist.
+	password, err := security.Random(32)
+	if err != nil {
+		log.Fatalf("ResourceOwnerPasswordCredentials failed to generate a password: %s", err)
+	}
+	unknownUserHash, err := hashers.Hash(password)
+	if err != nil {
+		log.Fatalf("ResourceOwnerPasswordCredentials failed to hash a password: %s", err)
+	}
+
+	gt := ResourceOwnerPasswordCredentialsGrantType{LoaderUserFromUsername: p, hashers: hashers, unknownUserHash: unknownUserHash}
+	gt.users, _ = p.(SaverUser)
+
+	return option.SomeString("password"), gt
 }
 
 // ResourceOwnerPasswordCredentialsGrantType implements the AuthorizationResponseType to allow for OAuth2's
 // client_credentials grant type.
 type ResourceOwnerPasswordCredentialsGrantType struct {
 	LoaderUserFromUsername
+	hashers         security.PasswordHashers
+	users           SaverUser
+	unknownUserHash string
 }
 
 // IssueToken issues a new token for the requesting client as defined by the client credential grant
@@ -51,7 +80,7 @@ func (g ResourceOwnerPasswordCredentialsGrantType) IssueToken(c *Client, params
 	var (
 		username = params.Get("username")
 		password = params.Get("password")
-		scopes   = strings.Split(params.Get("scope"), " ")
+		scopes   = strings.Fields(params.Get("scope"))
 	)
 
 	if username == "" || password == "" {
@@ -62,10 +91,24 @@ func (g ResourceOwnerPasswordCredentialsGrantType) IssueToken(c *Client, params
 	if err != nil {
 		return nil, ErrServerError
 	}
+	if u == nil {
+		g.hashers.Verify(g.unknownUserHash, []byte(password))
+		return nil, ErrAccessDenied
+	}
 
-	if !security.Compare(u.Password, []byte(password)) {
+	match, rehash, err := g.hashers.Verify(u.PasswordHash, []byte(password))
+	if err != nil || !match {
 		return nil, ErrAccessDenied
 	}
 
+	if rehash && g.users != nil {
+		if err := u.SetPassword(g.hashers, password); err != nil {
+			return nil, ErrServerError
+		}
+		if err := g.users.SaveUser(u); err != nil {
+			return nil, ErrServerError
+		}
+	}
+
 	return NewAccessToken(c, u, scopes)
 }
@@ -0,0 +1,106 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"net/http"
+
+	"github.com/satori/go.uuid"
+)
+
+// revocationEndpointHandler allows clients to notify that a token is no longer needed, as defined by
+// https://tools.ietf.org/html/rfc7009
+//
+// Once the client is authenticated the response is always successful, whether the token was
+// revoked, unknown or issued to another client, so it can't be used to probe for valid tokens.
+func (s *Server) revocationEndpointHandler(w http.ResponseWriter, req *http.Request) {
+	c, err := s.authenticateClientRequest(req)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	token := req.PostFormValue("token")
+	if token == "" {
+		respondError(w, ErrInvalidRequest)
+		return
+	}
+
+	// The hint only defines the lookup order, every supported token type is tried.
+	lookups := []func(*Client, string) (bool, error){s.revokeAccessToken, s.revokeRefreshToken}
+	if req.PostFormValue("token_type_hint") == "refresh_token" {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+
+	for _, revoke := range lookups {
+		found, err := revoke(c, token)
+		if err != nil {
+			respondError(w, ErrServerError)
+			return
+		}
+		if found {
+			break
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// revokeAccessToken revokes the access token if it was issued to the client. It returns whether
+// the token was found.
+func (s *Server) revokeAccessToken(c *Client, token string) (bool, error) {
+	loader, ok := s.persistence.(LoaderAccessTokenFromToken)
+	if !ok {
+		return false, nil
+	}
+
+	at, err := loader.LoadAccessTokenFromToken(token)
+	if err != nil || at == nil {
+		return false, err
+	}
+
+	if !uuid.Equal(at.Client.ID, c.ID) {
+		return true, nil
+	}
+
+	return true, s.RevokeAccessToken(token)
+}
+
+// revokeRefreshToken revokes the refresh token if it was issued to the client, along with every
+// token issued from the same authorization grant. It returns whether the token was found.
+func (s *Server) revokeRefreshToken(c *Client, token string) (bool, error) {
+	loader, ok := s.persistence.(LoaderRefreshTokenFromToken)
+	if !ok {
+		return false, nil
+	}
+
+	gt, ok := s.grantTypes["refresh_token"].(RefreshTokenGrantType)
+	if !ok {
+		return false, nil
+	}
+
+	rt, err := loader.LoadRefreshTokenFromToken(token)
+	if err != nil || rt == nil {
+		return false, err
+	}
+
+	if !uuid.Equal(rt.Client.ID, c.ID) {
+		return true, nil
+	}
+
+	return true, gt.RevokeFamily(rt.FamilyID)
+}
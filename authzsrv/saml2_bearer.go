@@ -0,0 +1,296 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/gostack/option"
+	"github.com/russellhaering/goxmldsig"
+)
+
+// GrantTypeSAML2Bearer is the grant type of the SAML 2.0 bearer assertion grant, as defined by
+// https://tools.ietf.org/html/rfc7522#section-2.1
+const GrantTypeSAML2Bearer = "urn:ietf:params:oauth:grant-type:saml2-bearer"
+
+// SAML namespace and identifiers used by the SAML2Bearer strategy, as defined by
+// https://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+const (
+	samlAssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlBearerMethod       = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+var errInvalidSAMLAssertion = errors.New("invalid SAML assertion")
+
+// SAML2IdentityProvider is a SAML identity provider trusted to issue assertions about users.
+type SAML2IdentityProvider struct {
+	// EntityID is the Issuer of the assertions issued by the identity provider.
+	EntityID string
+
+	// Certificates are the certificates the identity provider signs it's assertions with.
+	Certificates []*x509.Certificate
+}
+
+// SAML2Bearer implements the OAuth2 SAML 2.0 Bearer Assertion grant, allowing clients to exchange a
+// signed SAML assertion issued by a trusted identity provider for an access token on behalf of the
+// user it's subject of, as described by https://tools.ietf.org/html/rfc7522#section-2.1
+//
+// The NameID of the assertion subject is the username of the user, loaded using
+// LoaderUserFromUsername. Encrypted assertions are not supported.
+//
+// The Persistence provided to the Server must also implement ConsumerAssertionID.
+type SAML2Bearer struct {
+	// IdentityProviders are the identity providers trusted to issue assertions.
+	IdentityProviders []SAML2IdentityProvider
+
+	// Audience are the values accepted in the Audience of assertions, usually the entity ID or token
+	// endpoint URL of the server.
+	Audience []string
+
+	// Recipient is the token endpoint URL of the server, which must be the Recipient of the bearer
+	// subject confirmation.
+	Recipient string
+}
+
+// ResponseType simply registers a nil AuthorizationResponseType for SAML2Bearer
+func (s SAML2Bearer) ResponseType(_ Persistence) (option.String, AuthorizationResponseType) {
+	return option.NoneString(), nil
+}
+
+// GrantType registers the SAML 2.0 bearer grant type for SAML2Bearer.
+func (s SAML2Bearer) GrantType(p Persistence) (option.String, TokenGrantType) {
+	consumer, ok := p.(ConsumerAssertionID)
+	if !ok {
+		log.Fatalf("%T must implement ConsumerAssertionID to support the SAML2Bearer strategy", p)
+	}
+
+	if len(s.Audience) == 0 || s.Recipient == "" {
+		log.Fatalf("SAML2Bearer requires the Audience and Recipient of assertions to be configured")
+	}
+
+	gt := SAML2BearerGrantType{
+		LoaderUserFromUsername: p,
+		assertions:             consumer,
+		identityProviders:      make(map[string]SAML2IdentityProvider),
+		audience:               s.Audience,
+		recipient:              s.Recipient,
+	}
+
+	for _, idp := range s.IdentityProviders {
+		gt.identityProviders[idp.EntityID] = idp
+	}
+
+	return option.SomeString(GrantTypeSAML2Bearer), gt
+}
+
+// SAML2BearerGrantType implements the TokenGrantType to allow for OAuth2's SAML 2.0 bearer grant
+// type.
+type SAML2BearerGrantType struct {
+	LoaderUserFromUsername
+	assertions        ConsumerAssertionID
+	identityProviders map[string]SAML2IdentityProvider
+	audience          []string
+	recipient         string
+}
+
+// IssueToken issues a new token on behalf of the user the assertion is subject of, as defined by
+// https://tools.ietf.org/html/rfc7522#section-3
+func (g SAML2BearerGrantType) IssueToken(c *Client, params url.Values) (*AccessToken, error) {
+	encoded := params.Get("assertion")
+	if encoded == "" {
+		return nil, ErrInvalidRequest
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	a, err := g.verifyAssertion(raw)
+	if err != nil {
+		return nil, ErrInvalidGrant
+	}
+
+	expiresAt, err := a.validate(time.Now(), g.audience, g.recipient)
+	if err != nil {
+		return nil, ErrInvalidGrant
+	}
+
+	fresh, err := g.assertions.ConsumeAssertionID(a.Issuer, a.ID, expiresAt.Add(assertionLeeway))
+	if err != nil {
+		return nil, ErrServerError
+	}
+	if !fresh {
+		return nil, ErrInvalidGrant
+	}
+
+	u, err := g.LoadUserFromUsername(strings.TrimSpace(a.Subject.NameID))
+	if err != nil {
+		return nil, ErrServerError
+	}
+	if u == nil {
+		return nil, ErrInvalidGrant
+	}
+
+	return NewAccessToken(c, u, strings.Fields(params.Get("scope")))
+}
+
+// verifyAssertion verifies the assertion is signed by the identity provider that issued it, and
+// returns it's content. Only the signed content is returned, so any content added to the assertion
+// after it was signed is ignored.
+func (g SAML2BearerGrantType) verifyAssertion(raw []byte) (*samlAssertion, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return nil, err
+	}
+
+	root := doc.Root()
+	if root == nil || root.Tag != "Assertion" || root.NamespaceURI() != samlAssertionNamespace {
+		return nil, errInvalidSAMLAssertion
+	}
+
+	issuer := root.FindElement("./Issuer")
+	if issuer == nil {
+		return nil, errInvalidSAMLAssertion
+	}
+
+	idp, ok := g.identityProviders[strings.TrimSpace(issuer.Text())]
+	if !ok {
+		return nil, errInvalidSAMLAssertion
+	}
+
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: idp.Certificates})
+	signed, err := ctx.Validate(root)
+	if err != nil {
+		return nil, err
+	}
+
+	signedDoc := etree.NewDocument()
+	signedDoc.SetRoot(signed)
+	b, err := signedDoc.WriteToBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var a samlAssertion
+	if err := xml.Unmarshal(b, &a); err != nil {
+		return nil, err
+	}
+
+	a.Issuer = strings.TrimSpace(a.Issuer)
+	if a.Issuer != idp.EntityID {
+		return nil, errInvalidSAMLAssertion
+	}
+
+	return &a, nil
+}
+
+// samlAssertion is the content of a SAML 2.0 assertion relevant to the SAML2Bearer strategy.
+type samlAssertion struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	ID      string   `xml:"ID,attr"`
+	Version string   `xml:"Version,attr"`
+	Issuer  string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+
+	Subject struct {
+		NameID               string `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+		SubjectConfirmations []struct {
+			Method string `xml:"Method,attr"`
+			Data   struct {
+				NotBefore    time.Time `xml:"NotBefore,attr"`
+				NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+				Recipient    string    `xml:"Recipient,attr"`
+			} `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmationData"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmation"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
+
+	Conditions struct {
+		NotBefore            time.Time `xml:"NotBefore,attr"`
+		NotOnOrAfter         time.Time `xml:"NotOnOrAfter,attr"`
+		AudienceRestrictions []struct {
+			Audiences []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Audience"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:assertion AudienceRestriction"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Conditions"`
+}
+
+// validate validates the assertion is addressed to the server, currently valid and confirmed for
+// bearer use by the recipient, as defined by https://tools.ietf.org/html/rfc7522#section-3. It
+// returns the time the assertion expires at.
+func (a samlAssertion) validate(now time.Time, audience []string, recipient string) (time.Time, error) {
+	if a.Version != "2.0" || a.ID == "" || strings.TrimSpace(a.Subject.NameID) == "" {
+		return time.Time{}, errInvalidSAMLAssertion
+	}
+
+	// Every audience restriction must include the server as audience.
+	if len(a.Conditions.AudienceRestrictions) == 0 {
+		return time.Time{}, errInvalidSAMLAssertion
+	}
+	for _, ar := range a.Conditions.AudienceRestrictions {
+		if !containsAny(ar.Audiences, audience) {
+			return time.Time{}, errInvalidSAMLAssertion
+		}
+	}
+
+	if !a.Conditions.NotBefore.IsZero() && now.Add(assertionLeeway).Before(a.Conditions.NotBefore) {
+		return time.Time{}, errInvalidSAMLAssertion
+	}
+	if !a.Conditions.NotOnOrAfter.IsZero() && !now.Add(-assertionLeeway).Before(a.Conditions.NotOnOrAfter) {
+		return time.Time{}, errInvalidSAMLAssertion
+	}
+
+	// The bearer confirmation limits the time window the assertion can be used in, which applies
+	// along with the one of the conditions.
+	for _, sc := range a.Subject.SubjectConfirmations {
+		d := sc.Data
+		if sc.Method != samlBearerMethod || d.Recipient != recipient || d.NotOnOrAfter.IsZero() {
+			continue
+		}
+		if !d.NotBefore.IsZero() && now.Add(assertionLeeway).Before(d.NotBefore) {
+			continue
+		}
+		if !now.Add(-assertionLeeway).Before(d.NotOnOrAfter) {
+			continue
+		}
+
+		expiresAt := d.NotOnOrAfter
+		if !a.Conditions.NotOnOrAfter.IsZero() && a.Conditions.NotOnOrAfter.Before(expiresAt) {
+			expiresAt = a.Conditions.NotOnOrAfter
+		}
+		return expiresAt, nil
+	}
+
+	return time.Time{}, errInvalidSAMLAssertion
+}
+
+// containsAny returns whether any element of subset is present in set.
+func containsAny(set, subset []string) bool {
+	for _, s := range subset {
+		if contains(set, s) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import "sort"
+
+// Scope is a scope known by the Server, as defined by https://tools.ietf.org/html/rfc6749#section-3.3
+type Scope struct {
+	Name string
+
+	// Description is a human readable description of the access granted by the scope, usually
+	// displayed to the user when asking for it's consent.
+	Description string
+
+	// Default scopes are granted when the client doesn't request any scope.
+	Default bool
+}
+
+// RegisterScope adds a scope to the ones known by the server. Once any scope is registered,
+// requests for unknown scopes are rejected with ErrInvalidScope, while servers without registered
+// scopes grant any scope requested.
+func (s *Server) RegisterScope(sc Scope) {
+	s.scopes[sc.Name] = sc
+}
+
+// Scope returns the registered scope with the provided name.
+func (s *Server) Scope(name string) (Scope, bool) {
+	sc, ok := s.scopes[name]
+	return sc, ok
+}
+
+// scopeNames returns the names of the registered scopes, sorted.
+func (s *Server) scopeNames() []string {
+	names := make([]string, 0, len(s.scopes))
+	for name := range s.scopes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// grantScopes returns the scopes granted to the client out of the requested ones, which are the
+// default scopes when none are requested. Unknown scopes are rejected, while scopes the client is
+// not allowed to request are left out of the granted ones, unless none would be left.
+func (s *Server) grantScopes(c *Client, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		for _, name := range s.scopeNames() {
+			if s.scopes[name].Default {
+				requested = append(requested, name)
+			}
+		}
+	}
+
+	granted := make([]string, 0, len(requested))
+
+	for _, name := range requested {
+		if _, ok := s.scopes[name]; !ok && len(s.scopes) > 0 {
+			return nil, ErrInvalidScope
+		}
+		if !c.AllowsScope(name) || contains(granted, name) {
+			continue
+		}
+		granted = append(granted, name)
+	}
+
+	if len(requested) > 0 && len(granted) == 0 {
+		return nil, ErrInvalidScope
+	}
+
+	return granted, nil
+}
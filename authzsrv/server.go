@@ -20,55 +20,260 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/satori/go.uuid"
+)
+
+// Paths of the endpoints handled by the Server.
+const (
+	AuthorizationEndpointPath = "/authorize"
+	TokenEndpointPath         = "/token"
+	IntrospectionEndpointPath = "/introspect"
+	RevocationEndpointPath    = "/revoke"
+	JWKSEndpointPath          = "/.well-known/jwks.json"
+	MetadataEndpointPath      = "/.well-known/oauth-authorization-server"
 
-	"github.com/gostack/oauth22/security"
+	DeviceAuthorizationEndpointPath = "/device_authorization"
+	DeviceVerificationEndpointPath  = "/device"
+	UserInfoEndpointPath            = "/userinfo"
 )
 
+// UserAuthorizationHandler is the interface applications implement in order to authenticate the
+// resource owner and obtain it's decision on an authorization request.
+//
+// AuthorizeUser returns the User who approved the request. If the user still needs to login or
+// to confirm the request, it must write the response itself (e.g. rendering a login or consent page)
+// and return a nil User and error. Returning ErrAccessDenied informs the client that the user
+// denied the request.
+type UserAuthorizationHandler interface {
+	AuthorizeUser(w http.ResponseWriter, req *http.Request, ar *UserAuthorizationRequest) (*User, error)
+}
+
 // Server is the main class that implements the OAuth2 authorization server.
 type Server struct {
-	persistence   Persistence
-	mux           *http.ServeMux
-	responseTypes map[string]AuthorizationResponseType
-	grantTypes    map[string]TokenGrantType
+	issuer                   string
+	persistence              Persistence
+	mux                      *http.ServeMux
+	responseTypes            map[string]AuthorizationResponseType
+	grantTypes               map[string]TokenGrantType
+	refreshTokenIssuer       RefreshTokenIssuer
+	accessTokenGenerator     AccessTokenGenerator
+	keyManager               KeyManager
+	userAuthorizationHandler UserAuthorizationHandler
+	clientAuthenticators     map[string]ClientAuthenticator
+	scopes                   map[string]Scope
+
+	deviceVerificationHandler DeviceVerificationHandler
+	implicitGrantEnabled      bool
 }
 
 // NewServer instantiates a new Server configured for the provided Persistence.
 func NewServer(p Persistence) *Server {
 	srv := Server{
-		persistence:   p,
-		mux:           http.NewServeMux(),
-		responseTypes: make(map[string]AuthorizationResponseType),
-		grantTypes:    make(map[string]TokenGrantType),
+		persistence:          p,
+		mux:                  http.NewServeMux(),
+		responseTypes:        make(map[string]AuthorizationResponseType),
+		grantTypes:           make(map[string]TokenGrantType),
+		clientAuthenticators: make(map[string]ClientAuthenticator),
+		scopes:               make(map[string]Scope),
 	}
 
-	srv.mux.HandleFunc("/token", srv.tokenEndpointHandler)
+	srv.registerDefaultClientAuthenticators()
+
+	srv.mux.HandleFunc(AuthorizationEndpointPath, srv.authorizeEndpointHandler)
+	srv.mux.HandleFunc(TokenEndpointPath, srv.tokenEndpointHandler)
+	srv.mux.HandleFunc(IntrospectionEndpointPath, srv.introspectionEndpointHandler)
+	srv.mux.HandleFunc(RevocationEndpointPath, srv.revocationEndpointHandler)
+	srv.mux.HandleFunc(JWKSEndpointPath, srv.jwksEndpointHandler)
+	srv.mux.HandleFunc(MetadataEndpointPath, srv.metadataEndpointHandler)
+	srv.mux.HandleFunc(DeviceAuthorizationEndpointPath, srv.deviceAuthorizationEndpointHandler)
+	srv.mux.HandleFunc(DeviceVerificationEndpointPath, srv.deviceVerificationEndpointHandler)
+	srv.mux.HandleFunc(UserInfoEndpointPath, srv.userInfoEndpointHandler)
 	return &srv
 }
 
+// SetIssuer configures the issuer identifier of the server, which is the https URL the server is
+// reachable at. Endpoint URLs advertised by the server are relative to it, and it's required for
+// clients to authenticate using JWT assertions.
+func (s *Server) SetIssuer(issuer string) {
+	s.issuer = strings.TrimSuffix(issuer, "/")
+}
+
+// SetAccessTokenGenerator configures the generator used for the token of issued access tokens,
+// replacing the default opaque random tokens.
+func (s *Server) SetAccessTokenGenerator(g AccessTokenGenerator) {
+	s.accessTokenGenerator = g
+}
+
+// SetKeyManager configures the keys the server signs tokens with, publishing them in the JWKS
+// endpoint.
+func (s *Server) SetKeyManager(km KeyManager) {
+	s.keyManager = km
+}
+
+// SetUserAuthorizationHandler configures the handler used by the authorization endpoint to
+// authenticate the user and obtain it's consent.
+func (s *Server) SetUserAuthorizationHandler(h UserAuthorizationHandler) {
+	s.userAuthorizationHandler = h
+}
+
+// SetDeviceVerificationHandler configures the handler used by the device verification endpoint to
+// let the user approve the requests of devices using the DeviceCode strategy.
+func (s *Server) SetDeviceVerificationHandler(h DeviceVerificationHandler) {
+	s.deviceVerificationHandler = h
+}
+
+// EnableImplicitGrant enables the token response type of the Implicit strategy, which is otherwise
+// rejected as unsupported even if the strategy is registered.
+func (s *Server) EnableImplicitGrant() {
+	s.implicitGrantEnabled = true
+}
+
 // ServeHTTP implements the net/http interface, allowing a Server to handle a HTTP route.
-func (s Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	s.mux.ServeHTTP(w, req)
 }
 
 func (s *Server) RegisterStrategy(st Strategy) {
 	if name, rt := st.ResponseType(s.persistence); name.IsPresent() {
 		if rt == nil {
-			log.Fatal("%T ResponseType() returned name but nil AuthorizationResponseType", st)
+			log.Fatalf("%T ResponseType() returned name but nil AuthorizationResponseType", st)
 		}
 		s.responseTypes[name.Value()] = rt
 	}
 
 	if name, gt := st.GrantType(s.persistence); name.IsPresent() {
 		if gt == nil {
-			log.Fatal("%T GrantType() returned name but nil TokenGrantType", st)
+			log.Fatalf("%T GrantType() returned name but nil TokenGrantType", st)
 		}
 		s.grantTypes[name.Value()] = gt
+
+		if rti, ok := gt.(RefreshTokenIssuer); ok {
+			s.refreshTokenIssuer = rti
+		}
+	}
+}
+
+func (s *Server) authorizeEndpointHandler(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		respondError(w, ErrInvalidRequest)
+		return
+	}
+
+	q := req.Form
+
+	// Errors related to the client or redirection URI must not redirect the user-agent back to the
+	// client, as defined by https://tools.ietf.org/html/rfc6749#section-4.1.2.1
+	c, err := s.loadClient(q.Get("client_id"))
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	ar := UserAuthorizationRequest{
+		Client:       *c,
+		Scope:        strings.Fields(q.Get("scope")),
+		ResponseType: q.Get("response_type"),
+		RedirectURI:  q.Get("redirect_uri"),
+		State:        q.Get("state"),
+
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+
+		Nonce: q.Get("nonce"),
+	}
+
+	if ar.RedirectURI != "" && ar.RedirectURI != c.RedirectURI {
+		respondError(w, ErrInvalidRequest)
+		return
+	}
+	if _, err := url.Parse(ar.redirectURI()); err != nil || ar.redirectURI() == "" {
+		respondError(w, ErrInvalidRequest)
+		return
+	}
+
+	if ar.State == "" {
+		redirectError(w, req, &ar, ErrInvalidRequest)
+		return
 	}
+
+	responseType, ok := s.responseType(ar.ResponseType)
+	if !ok {
+		redirectError(w, req, &ar, ErrUnsupportedResponseType)
+		return
+	}
+	if !ar.Client.AllowsResponseType(ar.ResponseType) {
+		redirectError(w, req, &ar, ErrUnauthorizedClient)
+		return
+	}
+
+	if ar.Scope, err = s.grantScopes(c, ar.Scope); err != nil {
+		redirectError(w, req, &ar, err)
+		return
+	}
+
+	// ID tokens are only issued by servers with an issuer and signing keys, which is checked before
+	// the user authorizes the request rather than once the code is exchanged.
+	if contains(ar.Scope, ScopeOpenID) && !s.openIDEnabled() {
+		redirectError(w, req, &ar, ErrInvalidScope)
+		return
+	}
+
+	if v, ok := responseType.(AuthorizationRequestValidator); ok {
+		if err := v.ValidateRequest(&ar); err != nil {
+			redirectError(w, req, &ar, err)
+			return
+		}
+	}
+
+	if s.userAuthorizationHandler == nil {
+		redirectError(w, req, &ar, ErrServerError)
+		return
+	}
+
+	u, err := s.userAuthorizationHandler.AuthorizeUser(w, req, &ar)
+	if err != nil {
+		redirectError(w, req, &ar, err)
+		return
+	}
+	if u == nil {
+		return
+	}
+	ar.User = u
+
+	if ar.AuthTime.IsZero() {
+		ar.AuthTime = time.Now()
+	}
+
+	if err := responseType.Confirm(&ar, w); err != nil {
+		redirectError(w, req, &ar, err)
+		return
+	}
+
+	ua, err := responseType.Authorize(&ar)
+	if err != nil {
+		redirectError(w, req, &ar, err)
+		return
+	}
+
+	if ua.AccessToken != nil {
+		if err := s.generateAccessToken(ua.AccessToken); err != nil {
+			redirectError(w, req, &ar, err)
+			return
+		}
+		if err := s.saveAccessToken(ua.AccessToken); err != nil {
+			redirectError(w, req, &ar, err)
+			return
+		}
+	}
+
+	redirectResponse(w, req, &ar, ua.responseParams())
 }
 
-func (s Server) tokenEndpointHandler(w http.ResponseWriter, req *http.Request) {
+func (s *Server) tokenEndpointHandler(w http.ResponseWriter, req *http.Request) {
 	c, err := s.authenticateClientRequest(req)
 	if err != nil {
 		respondError(w, err)
@@ -92,68 +297,284 @@ func (s Server) tokenEndpointHandler(w http.ResponseWriter, req *http.Request) {
 		respondError(w, ErrUnsupportedGrantType)
 		return
 	}
+	if !c.AllowsGrantType(qGrantType) {
+		respondError(w, ErrUnauthorizedClient)
+		return
+	}
 
-	accessToken, err := grantType.IssueToken(c, q)
+	if c.Public() {
+		if pg, ok := grantType.(PublicClientGrantType); !ok || !pg.AllowsPublicClients() {
+			respondError(w, ErrUnauthorizedClient)
+			return
+		}
+	}
+
+	// The certificate is required before issuing the token, since grant types consume the
+	// authorization grant when issuing it.
+	var thumbprint string
+	if c.TLSClientCertificateBoundAccessTokens {
+		cert := peerCertificate(req)
+		if cert == nil {
+			respondError(w, ErrInvalidRequest)
+			return
+		}
+		thumbprint = CertificateThumbprint(cert)
+	}
+
+	var accessToken *AccessToken
+	if cg, ok := grantType.(CertificateGrantType); ok {
+		accessToken, err = cg.IssueTokenWithCertificate(c, q, peerCertificate(req))
+	} else {
+		accessToken, err = grantType.IssueToken(c, q)
+	}
 	if err != nil {
 		respondError(w, err)
 		return
 	}
 
+	if accessToken.Scopes, err = s.grantScopes(c, accessToken.Scopes); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	if thumbprint != "" {
+		accessToken.CertificateThumbprint = thumbprint
+	}
+
+	if err := s.generateAccessToken(accessToken); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	// ID tokens are issued for the authorization code flow, once the access token is final since
+	// the ID token includes it's hash.
+	if qGrantType == "authorization_code" && accessToken.User != nil && contains(accessToken.Scopes, ScopeOpenID) {
+		if accessToken.IDToken, err = s.generateIDToken(accessToken, q.Get("code")); err != nil {
+			respondError(w, err)
+			return
+		}
+	}
+
+	// Refresh tokens are only issued for tokens issued on behalf of a user, since clients acting on
+	// their own behalf can simply request a new token, and to clients allowed to use them. Tokens
+	// that are already part of a refresh token family, such as refreshed ones, keep it.
+	if s.refreshTokenIssuer != nil && accessToken.User != nil && uuid.Equal(accessToken.FamilyID, uuid.Nil) && c.AllowsGrantType("refresh_token") && refreshable(grantType) {
+		if err := s.refreshTokenIssuer.IssueRefreshToken(accessToken); err != nil {
+			respondError(w, err)
+			return
+		}
+	}
+
+	if err := s.saveAccessToken(accessToken); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	// The grant is only consumed once the token was saved. Should that fail, the saved token is
+	// revoked as it never reaches the client.
+	if cg, ok := grantType.(CommittingGrantType); ok {
+		if err := cg.CommitGrant(accessToken, q); err != nil {
+			if revoker, ok := s.persistence.(RevokerAccessToken); ok {
+				revoker.RevokeAccessToken(accessToken.Token)
+			}
+			respondError(w, err)
+			return
+		}
+	}
+
+	// Responses containing tokens must not be cached, as defined by
+	// https://tools.ietf.org/html/rfc6749#section-5.1
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
 	respondJSON(w, accessToken)
 }
 
-func (s Server) authenticateClientRequest(req *http.Request) (*Client, error) {
-	var textID, textSecret string
+// responseType returns the AuthorizationResponseType registered for the name, as long as it's
+// enabled.
+func (s *Server) responseType(name string) (AuthorizationResponseType, bool) {
+	if name == ResponseTypeToken && !s.implicitGrantEnabled {
+		return nil, false
+	}
+
+	rt, ok := s.responseTypes[name]
+	return rt, ok
+}
+
+// generateAccessToken replaces the token of the AccessToken with one from the configured generator,
+// if any.
+func (s *Server) generateAccessToken(at *AccessToken) error {
+	if s.accessTokenGenerator == nil {
+		return nil
+	}
+
+	t, err := s.accessTokenGenerator.GenerateAccessToken(at)
+	if err != nil {
+		return ErrServerError
+	}
+	at.Token = t
+
+	return nil
+}
 
-	if req.Header.Get("Authorization") != "" {
-		var ok bool
-		textID, textSecret, ok = req.BasicAuth()
-		if !ok {
-			return nil, ErrInvalidRequest
+// saveAccessToken saves the issued AccessToken, if the Persistence implements SaverAccessToken.
+func (s *Server) saveAccessToken(at *AccessToken) error {
+	if saver, ok := s.persistence.(SaverAccessToken); ok {
+		if err := saver.SaveAccessToken(at); err != nil {
+			return ErrServerError
 		}
-	} else {
-		textID = req.PostFormValue("client_id")
-		textSecret = req.PostFormValue("client_secret")
 	}
 
-	if textID == "" || textSecret == "" {
-		return nil, ErrInvalidClient
+	return nil
+}
+
+// LoadAccessToken loads a previously issued AccessToken from it's token, returning nil if the token
+// is unknown, revoked or expired. The Persistence provided to the Server must implement
+// LoaderAccessTokenFromToken.
+func (s *Server) LoadAccessToken(token string) (*AccessToken, error) {
+	loader, ok := s.persistence.(LoaderAccessTokenFromToken)
+	if !ok {
+		return nil, ErrServerError
 	}
 
-	var (
-		id     uuid.UUID
-		secret Secret
-	)
+	at, err := loader.LoadAccessTokenFromToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if at == nil || at.Expired() {
+		return nil, nil
+	}
 
-	if err := id.UnmarshalText([]byte(textID)); err != nil {
-		return nil, ErrInvalidRequest
+	return at, nil
+}
+
+// RevokeAccessToken revokes a previously issued AccessToken. The Persistence provided to the Server
+// must implement RevokerAccessToken.
+func (s *Server) RevokeAccessToken(token string) error {
+	revoker, ok := s.persistence.(RevokerAccessToken)
+	if !ok {
+		return ErrServerError
+	}
+
+	return revoker.RevokeAccessToken(token)
+}
+
+// refreshable returns whether refresh tokens can be issued along with tokens of the grant type.
+func refreshable(gt TokenGrantType) bool {
+	ng, ok := gt.(NonRefreshableGrantType)
+	return !ok || !ng.DisallowsRefreshTokens()
+}
+
+// issuerFor returns the configured issuer or, when none is configured, the one derived from the
+// request.
+func (s *Server) issuerFor(req *http.Request) string {
+	if s.issuer != "" {
+		return s.issuer
+	}
+
+	scheme := "https"
+	if req.TLS == nil {
+		scheme = "http"
+	}
+
+	return scheme + "://" + req.Host
+}
+
+// loadClient loads the Client identified by the provided textual ID.
+func (s *Server) loadClient(textID string) (*Client, error) {
+	var id uuid.UUID
+
+	if textID == "" {
+		return nil, ErrInvalidClient
 	}
-	if err := secret.UnmarshalText([]byte(textSecret)); err != nil {
+	if err := id.UnmarshalText([]byte(textID)); err != nil {
 		return nil, ErrInvalidRequest
 	}
 
 	c, err := s.persistence.LoadClientFromID(id)
-	if err, ok := err.(*OAuth2Error); ok {
+	if err, ok := err.(OAuth2Error); ok {
 		return nil, err
 	}
 	if err != nil {
 		return nil, ErrServerError
 	}
-
-	if !security.Compare(c.Secret, secret) {
+	if c == nil {
 		return nil, ErrInvalidClient
 	}
 
 	return c, nil
 }
 
+// redirect sends the user-agent back to the client's redirection URI with the provided parameters
+// added to it's query component.
+func redirect(w http.ResponseWriter, req *http.Request, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		respondError(w, ErrInvalidRequest)
+		return
+	}
+
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	http.Redirect(w, req, u.String(), http.StatusFound)
+}
+
+// redirectFragment sends the user-agent back to the client's redirection URI with the provided
+// parameters as it's fragment component.
+func redirectFragment(w http.ResponseWriter, req *http.Request, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		respondError(w, ErrInvalidRequest)
+		return
+	}
+	u.Fragment = ""
+
+	http.Redirect(w, req, u.String()+"#"+params.Encode(), http.StatusFound)
+}
+
+// redirectResponse sends the authorization response back to the client, in the fragment component
+// of the redirection URI for the token response type, as defined by
+// https://tools.ietf.org/html/rfc6749#section-4.2.2
+func redirectResponse(w http.ResponseWriter, req *http.Request, ar *UserAuthorizationRequest, params url.Values) {
+	if ar.ResponseType == ResponseTypeToken {
+		redirectFragment(w, req, ar.redirectURI(), params)
+		return
+	}
+
+	redirect(w, req, ar.redirectURI(), params)
+}
+
+// redirectError informs the client about an error processing the authorization request, as defined by
+// https://tools.ietf.org/html/rfc6749#section-4.1.2.1 and https://tools.ietf.org/html/rfc6749#section-4.2.2.1
+func redirectError(w http.ResponseWriter, req *http.Request, ar *UserAuthorizationRequest, err error) {
+	oerr, ok := err.(OAuth2Error)
+	if !ok {
+		oerr = ErrServerError
+	}
+
+	params := url.Values{}
+	params.Set("error", oerr.ID)
+	params.Set("error_description", oerr.Desc)
+	if ar.State != "" {
+		params.Set("state", ar.State)
+	}
+
+	redirectResponse(w, req, ar, params)
+}
+
 func respondJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(v); err != nil {
 		panic(err)
 	}
 }
 
 func respondError(w http.ResponseWriter, err error) {
+	// Headers must be set before the status is written, so respondJSON can't set it in time.
+	w.Header().Set("Content-Type", "application/json")
 	if err, ok := err.(OAuth2Error); ok {
 		w.WriteHeader(err.Code)
 		respondJSON(w, err)
@@ -17,6 +17,7 @@ limitations under the License.
 package authzsrv
 
 import (
+	"crypto/x509"
 	"net/http"
 	"net/url"
 
@@ -31,6 +32,8 @@ type Strategy interface {
 }
 
 // AuthorizationResponseType is the interface that represents a valid OAuth2 response type, used by the authorization endpoint.
+// Confirm and Authorize are only called once the resource owner approved the request. Confirm
+// returning an error rejects the request, which is reported back to the client.
 type AuthorizationResponseType interface {
 	Confirm(ar *UserAuthorizationRequest, w http.ResponseWriter) error
 	Authorize(ar *UserAuthorizationRequest) (*UserAuthorization, error)
@@ -40,3 +43,41 @@ type AuthorizationResponseType interface {
 type TokenGrantType interface {
 	IssueToken(c *Client, params url.Values) (*AccessToken, error)
 }
+
+// AuthorizationRequestValidator is an optional interface for AuthorizationResponseType that need to
+// validate response type specific parameters before the user is asked to authorize the request.
+type AuthorizationRequestValidator interface {
+	ValidateRequest(ar *UserAuthorizationRequest) error
+}
+
+// RefreshTokenIssuer is an optional interface for TokenGrantType that are able to issue refresh
+// tokens for access tokens issued by other grant types.
+type RefreshTokenIssuer interface {
+	IssueRefreshToken(at *AccessToken) error
+}
+
+// PublicClientGrantType is an optional interface for TokenGrantType that public clients are allowed
+// to use, since they don't rely on the client authentication alone.
+type PublicClientGrantType interface {
+	AllowsPublicClients() bool
+}
+
+// CertificateGrantType is an optional interface for TokenGrantType that need the certificate the
+// client presented in the mutual TLS connection, if any, such as to verify the certificate binding of
+// tokens provided as grants. IssueTokenWithCertificate is called instead of IssueToken.
+type CertificateGrantType interface {
+	IssueTokenWithCertificate(c *Client, params url.Values, cert *x509.Certificate) (*AccessToken, error)
+}
+
+// CommittingGrantType is an optional interface for TokenGrantType that only consume the grant once
+// the server validated and saved the issued token, so a token rejected by the server doesn't use up
+// the grant. CommitGrant is called with the same parameters as IssueToken.
+type CommittingGrantType interface {
+	CommitGrant(at *AccessToken, params url.Values) error
+}
+
+// NonRefreshableGrantType is an optional interface for TokenGrantType whose tokens must not be
+// issued along with refresh tokens.
+type NonRefreshableGrantType interface {
+	DisallowsRefreshTokens() bool
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"crypto/x509"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gostack/option"
+	"github.com/satori/go.uuid"
+)
+
+// GrantTypeTokenExchange is the grant type of the token exchange grant, as defined by
+// https://tools.ietf.org/html/rfc8693#section-2.1
+const GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+// TokenTypeAccessToken is the token type identifier of access tokens issued by the server, as
+// defined by https://tools.ietf.org/html/rfc8693#section-3
+const TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+// TokenExchange implements the OAuth2 Token Exchange grant type, allowing clients to exchange an
+// access token for a new one, usually narrower and addressed to another service, as described by
+// https://tools.ietf.org/html/rfc8693
+//
+// Requests without an actor_token impersonate the subject of the subject_token, while requests
+// with one are delegated, the issued token identifying the actor in it's act claim.
+//
+// The Persistence provided to the Server must also implement LoaderAccessTokenFromToken.
+type TokenExchange struct {
+	// Policy decides on the audience and scopes of the issued tokens. When nil, tokens can only be
+	// exchanged for tokens with the same audience and the same or narrower scopes.
+	Policy TokenExchangePolicy
+}
+
+// TokenExchangePolicy is the interface applications implement in order to decide on token exchange
+// requests, once the subject and actor tokens were validated.
+//
+// AuthorizeExchange returns the audience and scopes of the token to be issued, or an error such as
+// ErrInvalidTarget, ErrInvalidScope or ErrAccessDenied if the exchange is not allowed.
+type TokenExchangePolicy interface {
+	AuthorizeExchange(er *TokenExchangeRequest) (audience, scopes []string, err error)
+}
+
+// ForeignSubjectTokenExchangePolicy is an optional interface for TokenExchangePolicy that allow
+// clients to exchange subject tokens on behalf of a user that were neither issued to them nor
+// include them in their audience. Such exchanges are rejected unless AllowsForeignSubject returns
+// true, so clients can't launder tokens issued to other clients.
+type ForeignSubjectTokenExchangePolicy interface {
+	AllowsForeignSubject(er *TokenExchangeRequest) bool
+}
+
+// TokenExchangeRequest is a token exchange request made by a client, as defined by
+// https://tools.ietf.org/html/rfc8693#section-2.1
+type TokenExchangeRequest struct {
+	Client  *Client
+	Subject *AccessToken
+
+	// Actor is the token of the party acting on behalf of the subject, or nil for impersonation.
+	Actor *AccessToken
+
+	// Audience contains both the audience and resource parameters of the request, while Scopes
+	// contains the requested scopes, which are empty when not provided.
+	Audience []string
+	Scopes   []string
+}
+
+// Actor is the act claim, identifying the party acting on behalf of the subject of a delegated
+// token, along with prior actors in a delegation chain, as defined by
+// https://tools.ietf.org/html/rfc8693#section-4.1
+type Actor struct {
+	Subject  string `json:"sub"`
+	ClientID string `json:"client_id,omitempty"`
+	Actor    *Actor `json:"act,omitempty"`
+}
+
+// ResponseType simply registers a nil AuthorizationResponseType for TokenExchange
+func (s TokenExchange) ResponseType(_ Persistence) (option.String, AuthorizationResponseType) {
+	return option.NoneString(), nil
+}
+
+// GrantType registers the token exchange grant type for TokenExchange.
+func (s TokenExchange) GrantType(p Persistence) (option.String, TokenGrantType) {
+	lp, ok := p.(LoaderAccessTokenFromToken)
+	if !ok {
+		log.Fatalf("%T must implement LoaderAccessTokenFromToken to support the TokenExchange strategy", p)
+	}
+
+	policy := s.Policy
+	if policy == nil {
+		policy = defaultTokenExchangePolicy{}
+	}
+
+	return option.SomeString(GrantTypeTokenExchange), TokenExchangeGrantType{lp, policy}
+}
+
+// TokenExchangeGrantType implements the TokenGrantType to allow for OAuth2's token exchange grant
+// type.
+type TokenExchangeGrantType struct {
+	LoaderAccessTokenFromToken
+	policy TokenExchangePolicy
+}
+
+// IssueToken exchanges the subject token for a new token, as done by IssueTokenWithCertificate for
+// requests without a client certificate.
+func (g TokenExchangeGrantType) IssueToken(c *Client, params url.Values) (*AccessToken, error) {
+	return g.IssueTokenWithCertificate(c, params, nil)
+}
+
+// IssueTokenWithCertificate exchanges the subject token for a new token, with the audience and
+// scopes decided by the policy, as defined by https://tools.ietf.org/html/rfc8693#section-2.2
+//
+// Subject and actor tokens bound to a certificate are only accepted when presented with it.
+func (g TokenExchangeGrantType) IssueTokenWithCertificate(c *Client, params url.Values, cert *x509.Certificate) (*AccessToken, error) {
+	if t := params.Get("requested_token_type"); t != "" && t != TokenTypeAccessToken {
+		return nil, ErrInvalidRequest
+	}
+
+	subject, err := g.loadExchangedToken(params.Get("subject_token"), params.Get("subject_token_type"), cert)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens issued to clients acting on their own behalf have no other subject than the client,
+	// so only the client itself can exchange them.
+	if subject.User == nil && !uuid.Equal(subject.Client.ID, c.ID) {
+		return nil, ErrInvalidGrant
+	}
+
+	er := TokenExchangeRequest{
+		Client:   c,
+		Subject:  subject,
+		Audience: append(append([]string{}, params["audience"]...), params["resource"]...),
+		Scopes:   strings.Fields(params.Get("scope")),
+	}
+
+	if params.Get("actor_token") != "" {
+		if er.Actor, err = g.loadExchangedToken(params.Get("actor_token"), params.Get("actor_token_type"), cert); err != nil {
+			return nil, err
+		}
+	} else if params.Get("actor_token_type") != "" {
+		return nil, ErrInvalidRequest
+	}
+
+	// Tokens issued on behalf of a user can only be exchanged by clients they were issued to or
+	// addressed to, unless the policy explicitly allows otherwise.
+	if !uuid.Equal(subject.Client.ID, c.ID) && !contains(subject.Audience, c.ID.String()) {
+		fp, ok := g.policy.(ForeignSubjectTokenExchangePolicy)
+		if !ok || !fp.AllowsForeignSubject(&er) {
+			return nil, ErrInvalidGrant
+		}
+	}
+
+	audience, scopes, err := g.policy.AuthorizeExchange(&er)
+	if err != nil {
+		return nil, err
+	}
+
+	at, err := NewAccessToken(c, subject.User, scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	at.Audience = audience
+	at.IssuedTokenType = TokenTypeAccessToken
+
+	at.Actor = subject.Actor
+	if er.Actor != nil {
+		at.Actor = &Actor{Subject: er.Actor.Subject(), ClientID: er.Actor.Client.ID.String(), Actor: subject.Actor}
+	}
+
+	// The issued token never outlives the subject token.
+	if remaining := time.Until(subject.ExpiresAt()); remaining < at.ExpiresIn {
+		at.ExpiresIn = remaining
+	}
+
+	return at, nil
+}
+
+// DisallowsRefreshTokens prevents refresh tokens from being issued for exchanged tokens, as they
+// would lose the audience and actor of the token when refreshed.
+func (g TokenExchangeGrantType) DisallowsRefreshTokens() bool {
+	return true
+}
+
+// loadExchangedToken loads the active access token provided as subject or actor token, verifying
+// it's bound to the client certificate, if any.
+func (g TokenExchangeGrantType) loadExchangedToken(token, tokenType string, cert *x509.Certificate) (*AccessToken, error) {
+	if token == "" || tokenType != TokenTypeAccessToken {
+		return nil, ErrInvalidRequest
+	}
+
+	at, err := g.LoadAccessTokenFromToken(token)
+	if err != nil {
+		return nil, ErrServerError
+	}
+	if at == nil || at.Expired() || !at.VerifyCertificate(cert) {
+		return nil, ErrInvalidGrant
+	}
+
+	return at, nil
+}
+
+// defaultTokenExchangePolicy is the TokenExchangePolicy used when none is configured, only allowing
+// tokens to be exchanged for narrower ones.
+type defaultTokenExchangePolicy struct{}
+
+func (p defaultTokenExchangePolicy) AuthorizeExchange(er *TokenExchangeRequest) ([]string, []string, error) {
+	if len(er.Audience) > 0 {
+		return nil, nil, ErrInvalidTarget
+	}
+
+	if len(er.Scopes) == 0 {
+		return er.Subject.Audience, er.Subject.Scopes, nil
+	}
+	if !containsAll(er.Subject.Scopes, er.Scopes) {
+		return nil, nil, ErrInvalidScope
+	}
+
+	return er.Subject.Audience, er.Scopes, nil
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authzsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// UserClaims are the standard claims about a User, as defined by
+// https://openid.net/specs/openid-connect-core-1_0.html#StandardClaims
+//
+// The sub claim is always the username of the user, so it's not part of the UserClaims. The
+// verification claims are pointers so they're only returned when known.
+type UserClaims struct {
+	Name                string   `json:"name,omitempty"`
+	GivenName           string   `json:"given_name,omitempty"`
+	FamilyName          string   `json:"family_name,omitempty"`
+	MiddleName          string   `json:"middle_name,omitempty"`
+	Nickname            string   `json:"nickname,omitempty"`
+	PreferredUsername   string   `json:"preferred_username,omitempty"`
+	Profile             string   `json:"profile,omitempty"`
+	Picture             string   `json:"picture,omitempty"`
+	Website             string   `json:"website,omitempty"`
+	Email               string   `json:"email,omitempty"`
+	EmailVerified       *bool    `json:"email_verified,omitempty"`
+	Gender              string   `json:"gender,omitempty"`
+	Birthdate           string   `json:"birthdate,omitempty"`
+	Zoneinfo            string   `json:"zoneinfo,omitempty"`
+	Locale              string   `json:"locale,omitempty"`
+	PhoneNumber         string   `json:"phone_number,omitempty"`
+	PhoneNumberVerified *bool    `json:"phone_number_verified,omitempty"`
+	Address             *Address `json:"address,omitempty"`
+	UpdatedAt           int64    `json:"updated_at,omitempty"`
+}
+
+// Address is the address claim, as defined by
+// https://openid.net/specs/openid-connect-core-1_0.html#AddressClaim
+type Address struct {
+	Formatted     string `json:"formatted,omitempty"`
+	StreetAddress string `json:"street_address,omitempty"`
+	Locality      string `json:"locality,omitempty"`
+	Region        string `json:"region,omitempty"`
+	PostalCode    string `json:"postal_code,omitempty"`
+	Country       string `json:"country,omitempty"`
+}
+
+// scopeClaims are the claims disclosed for each scope, as defined by
+// https://openid.net/specs/openid-connect-core-1_0.html#ScopeClaims
+var scopeClaims = map[string][]string{
+	"profile": {"name", "family_name", "given_name", "middle_name", "nickname", "preferred_username",
+		"profile", "picture", "website", "gender", "birthdate", "zoneinfo", "locale", "updated_at"},
+	"email":   {"email", "email_verified"},
+	"address": {"address"},
+	"phone":   {"phone_number", "phone_number_verified"},
+}
+
+// filter returns the claims disclosed for the scopes, along with the subject.
+func (c UserClaims) filter(sub string, scopes []string) (map[string]interface{}, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]interface{}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{"sub": sub}
+	for _, scope := range scopes {
+		for _, name := range scopeClaims[scope] {
+			if v, ok := all[name]; ok {
+				claims[name] = v
+			}
+		}
+	}
+
+	return claims, nil
+}
+
+// userInfoEndpointHandler returns the claims about the user the bearer access token was issued on
+// behalf of, as defined by https://openid.net/specs/openid-connect-core-1_0.html#UserInfo
+func (s *Server) userInfoEndpointHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, err := bearerToken(req)
+	if err != nil {
+		respondBearerError(w, err)
+		return
+	}
+
+	// Requests without any authentication are only challenged, as defined by
+	// https://tools.ietf.org/html/rfc6750#section-3.1
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	at, err := s.LoadAccessToken(token)
+	if err != nil {
+		respondBearerError(w, ErrServerError)
+		return
+	}
+	if at == nil || at.User == nil || !at.VerifyCertificate(peerCertificate(req)) {
+		respondBearerError(w, ErrInvalidToken)
+		return
+	}
+	if !contains(at.Scopes, ScopeOpenID) {
+		respondBearerError(w, ErrInsufficientScope)
+		return
+	}
+
+	var uc UserClaims
+	if cp, ok := s.persistence.(ClaimsProvider); ok {
+		c, err := cp.LoadUserClaims(at.User)
+		if err != nil {
+			respondBearerError(w, ErrServerError)
+			return
+		}
+		if c != nil {
+			uc = *c
+		}
+	}
+
+	claims, err := uc.filter(at.Subject(), at.Scopes)
+	if err != nil {
+		respondBearerError(w, ErrServerError)
+		return
+	}
+
+	respondJSON(w, claims)
+}
+
+// bearerToken returns the bearer access token sent in the Authorization header or the form body
+// of the request, as defined by https://tools.ietf.org/html/rfc6750#section-2. An empty token is
+// returned when none was sent.
+func bearerToken(req *http.Request) (string, error) {
+	var token string
+
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			return "", ErrInvalidRequest
+		}
+		token = strings.TrimSpace(auth[7:])
+	}
+
+	if req.Method == http.MethodPost {
+		if t := req.PostFormValue("access_token"); t != "" {
+			// Clients must not use more than one method to transmit the token.
+			if token != "" {
+				return "", ErrInvalidRequest
+			}
+			token = t
+		}
+	}
+
+	return token, nil
+}
+
+// respondBearerError responds to a request made with an invalid bearer token, challenging the
+// client, as defined by https://tools.ietf.org/html/rfc6750#section-3
+func respondBearerError(w http.ResponseWriter, err error) {
+	if err, ok := err.(OAuth2Error); ok && err.Code != http.StatusInternalServerError {
+		w.Header().Set("WWW-Authenticate", `Bearer error="`+err.ID+`"`)
+	}
+
+	respondError(w, err)
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jose
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	ErrExpired         = errors.New("token is expired")
+	ErrNotYetValid     = errors.New("token is not valid yet")
+	ErrInvalidIssuer   = errors.New("token issuer is invalid")
+	ErrInvalidAudience = errors.New("token audience is invalid")
+)
+
+// Audience is the aud claim, which can be either a single string or an array of strings.
+type Audience []string
+
+// MarshalJSON serializes single valued audiences as a string.
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+
+	return json.Marshal([]string(a))
+}
+
+// UnmarshalJSON accepts both the string and array representations.
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// Contains returns whether the audience includes the provided value.
+func (a Audience) Contains(v string) bool {
+	for _, e := range a {
+		if e == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Claims are the registered claims, as defined by https://tools.ietf.org/html/rfc7519#section-4.1
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+}
+
+// Validate validates the time based claims against the provided time, allowing for the provided
+// leeway to account for clock skew. The exp claim is required.
+func (c Claims) Validate(now time.Time, leeway time.Duration) error {
+	if c.ExpiresAt == 0 || now.Add(-leeway).Unix() >= c.ExpiresAt {
+		return ErrExpired
+	}
+	if c.NotBefore != 0 && now.Add(leeway).Unix() < c.NotBefore {
+		return ErrNotYetValid
+	}
+
+	return nil
+}
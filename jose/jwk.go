@@ -0,0 +1,192 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+var ErrUnsupportedKey = errors.New("unsupported key type")
+
+// JSONWebKey is the JSON representation of a public key, as defined by
+// https://tools.ietf.org/html/rfc7517
+type JSONWebKey struct {
+	Key          crypto.PublicKey
+	KeyID        string
+	Algorithm    string
+	Use          string
+	Certificates []*x509.Certificate
+}
+
+// NewJSONWebKey returns the public JSONWebKey for the SigningKey, to be used for verifying
+// signatures.
+func NewJSONWebKey(k *SigningKey) JSONWebKey {
+	return JSONWebKey{Key: k.Public(), KeyID: k.ID, Algorithm: k.Algorithm, Use: "sig"}
+}
+
+type jsonWebKey struct {
+	KeyType   string   `json:"kty"`
+	KeyID     string   `json:"kid,omitempty"`
+	Algorithm string   `json:"alg,omitempty"`
+	Use       string   `json:"use,omitempty"`
+	Curve     string   `json:"crv,omitempty"`
+	N         string   `json:"n,omitempty"`
+	E         string   `json:"e,omitempty"`
+	X         string   `json:"x,omitempty"`
+	Y         string   `json:"y,omitempty"`
+	X5C       []string `json:"x5c,omitempty"`
+}
+
+// MarshalJSON serializes the key using the parameters defined for it's key type by
+// https://tools.ietf.org/html/rfc7518#section-6 and https://tools.ietf.org/html/rfc8037#section-2
+func (k JSONWebKey) MarshalJSON() ([]byte, error) {
+	jwk := jsonWebKey{KeyID: k.KeyID, Algorithm: k.Algorithm, Use: k.Use}
+
+	for _, cert := range k.Certificates {
+		jwk.X5C = append(jwk.X5C, base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+
+	switch key := k.Key.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = encodeSegment(key.N.Bytes())
+		jwk.E = encodeSegment(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, ErrUnsupportedKey
+		}
+
+		ecdh, err := key.ECDH()
+		if err != nil {
+			return nil, err
+		}
+
+		// Uncompressed point encoding: 0x04 || X || Y
+		point := ecdh.Bytes()
+		jwk.KeyType = "EC"
+		jwk.Curve = "P-256"
+		jwk.X = encodeSegment(point[1:33])
+		jwk.Y = encodeSegment(point[33:])
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = encodeSegment(key)
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	return json.Marshal(jwk)
+}
+
+// UnmarshalJSON deserializes public keys of the supported key types.
+func (k *JSONWebKey) UnmarshalJSON(b []byte) error {
+	var jwk jsonWebKey
+	if err := json.Unmarshal(b, &jwk); err != nil {
+		return err
+	}
+
+	switch {
+	case jwk.KeyType == "RSA":
+		n, err := decodeSegment(jwk.N)
+		if err != nil {
+			return err
+		}
+		e, err := decodeSegment(jwk.E)
+		if err != nil {
+			return err
+		}
+
+		k.Key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case jwk.KeyType == "EC" && jwk.Curve == "P-256":
+		x, err := decodeSegment(jwk.X)
+		if err != nil {
+			return err
+		}
+		y, err := decodeSegment(jwk.Y)
+		if err != nil {
+			return err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return ErrUnsupportedKey
+		}
+
+		point := append(append([]byte{4}, x...), y...)
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return err
+		}
+		k.Key = key
+	case jwk.KeyType == "OKP" && jwk.Curve == "Ed25519":
+		x, err := decodeSegment(jwk.X)
+		if err != nil {
+			return err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return ErrUnsupportedKey
+		}
+
+		k.Key = ed25519.PublicKey(x)
+	default:
+		return ErrUnsupportedKey
+	}
+
+	// The x5c certificates are encoded using the standard base64 encoding, with padding.
+	// https://tools.ietf.org/html/rfc7517#section-4.7
+	k.Certificates = nil
+	for _, c := range jwk.X5C {
+		der, err := base64.StdEncoding.DecodeString(c)
+		if err != nil {
+			return err
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		k.Certificates = append(k.Certificates, cert)
+	}
+
+	k.KeyID = jwk.KeyID
+	k.Algorithm = jwk.Algorithm
+	k.Use = jwk.Use
+	return nil
+}
+
+// JSONWebKeySet is a set of public keys, as defined by https://tools.ietf.org/html/rfc7517#section-5
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// Key returns the key in the set with the provided ID, or nil if there is none.
+func (s JSONWebKeySet) Key(kid string) *JSONWebKey {
+	for i := range s.Keys {
+		if s.Keys[i].KeyID == kid {
+			return &s.Keys[i]
+		}
+	}
+
+	return nil
+}
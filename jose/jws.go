@@ -0,0 +1,268 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// Signature algorithms supported, as defined by https://tools.ietf.org/html/rfc7518#section-3.1
+// and https://tools.ietf.org/html/rfc8037#section-3.1
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+var (
+	ErrMalformed            = errors.New("malformed token")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signature algorithm")
+	ErrInvalidSignature     = errors.New("invalid signature")
+)
+
+// SigningKey is a private key used to sign tokens, along with the algorithm it uses and the ID
+// advertised in the token header so verifiers can pick the right public key.
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	Key       crypto.Signer
+}
+
+// NewSigningKey creates a SigningKey for the provided private key, inferring the algorithm from it's
+// type. RSA keys use RS256, P-256 ECDSA keys use ES256 and Ed25519 keys use EdDSA.
+func NewSigningKey(id string, key crypto.Signer) (*SigningKey, error) {
+	alg, err := algorithmForKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{ID: id, Algorithm: alg, Key: key}, nil
+}
+
+// Public returns the public key matching the SigningKey.
+func (k SigningKey) Public() crypto.PublicKey {
+	return k.Key.Public()
+}
+
+// algorithmForKey returns the signature algorithm used with the provided public key.
+func algorithmForKey(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case []byte:
+		return HS256, nil
+	case *rsa.PublicKey:
+		return RS256, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", ErrUnsupportedAlgorithm
+		}
+		return ES256, nil
+	case ed25519.PublicKey:
+		return EdDSA, nil
+	default:
+		return "", ErrUnsupportedAlgorithm
+	}
+}
+
+// Header is the JOSE header of a signed token.
+type Header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// Sign serializes the claims and signs them using the provided key, returning the token in the JWS
+// compact serialization. The typ header is only set when not empty.
+func Sign(key *SigningKey, typ string, claims interface{}) (string, error) {
+	input, err := signingInput(Header{Algorithm: key.Algorithm, Type: typ, KeyID: key.ID}, claims)
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := sign(key, []byte(input))
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + encodeSegment(sig), nil
+}
+
+// SignHMAC works like Sign, using HS256 with the provided shared secret.
+func SignHMAC(secret []byte, typ string, claims interface{}) (string, error) {
+	input, err := signingInput(Header{Algorithm: HS256, Type: typ}, claims)
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + encodeSegment(hmacSHA256(secret, []byte(input))), nil
+}
+
+func signingInput(h Header, claims interface{}) (string, error) {
+	header, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeSegment(header) + "." + encodeSegment(payload), nil
+}
+
+func hmacSHA256(secret, input []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func sign(key *SigningKey, input []byte) ([]byte, error) {
+	switch key.Algorithm {
+	case RS256:
+		sum := sha256.Sum256(input)
+		return key.Key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	case ES256:
+		k, ok := key.Key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, ErrUnsupportedAlgorithm
+		}
+
+		// JWS uses the fixed size concatenation of R and S instead of the ASN.1 encoding.
+		// https://tools.ietf.org/html/rfc7518#section-3.4
+		sum := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		if err != nil {
+			return nil, err
+		}
+
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	case EdDSA:
+		return key.Key.Sign(rand.Reader, input, crypto.Hash(0))
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+}
+
+// Token is a parsed, but not yet verified, signed token.
+type Token struct {
+	Header    Header
+	Payload   []byte
+	input     []byte
+	signature []byte
+}
+
+// Parse parses a token in the JWS compact serialization. The signature must be checked with Verify
+// before trusting any of it's content.
+func Parse(s string) (*Token, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var t Token
+
+	header, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if err := json.Unmarshal(header, &t.Header); err != nil {
+		return nil, ErrMalformed
+	}
+
+	if t.Payload, err = decodeSegment(parts[1]); err != nil {
+		return nil, ErrMalformed
+	}
+	if t.signature, err = decodeSegment(parts[2]); err != nil {
+		return nil, ErrMalformed
+	}
+
+	t.input = []byte(parts[0] + "." + parts[1])
+	return &t, nil
+}
+
+// Verify verifies the token signature using the provided public key, or shared secret as a []byte for
+// HS256. The algorithm in the header must be the one used with the key type, preventing algorithm
+// substitution attacks.
+func (t Token) Verify(key crypto.PublicKey) error {
+	alg, err := algorithmForKey(key)
+	if err != nil {
+		return err
+	}
+	if alg != t.Header.Algorithm {
+		return ErrInvalidSignature
+	}
+
+	var valid bool
+
+	switch k := key.(type) {
+	case []byte:
+		valid = hmac.Equal(hmacSHA256(k, t.input), t.signature)
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(t.input)
+		valid = rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], t.signature) == nil
+	case *ecdsa.PublicKey:
+		if len(t.signature) != 64 {
+			return ErrInvalidSignature
+		}
+
+		sum := sha256.Sum256(t.input)
+		r := new(big.Int).SetBytes(t.signature[:32])
+		s := new(big.Int).SetBytes(t.signature[32:])
+		valid = ecdsa.Verify(k, sum[:], r, s)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, t.input, t.signature)
+	}
+
+	if !valid {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// Claims deserializes the token payload into v.
+func (t Token) Claims(v interface{}) error {
+	if err := json.Unmarshal(t.Payload, v); err != nil {
+		return ErrMalformed
+	}
+
+	return nil
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
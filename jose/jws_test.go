@@ -0,0 +1,165 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func generateKeys(t *testing.T) []crypto.Signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []crypto.Signer{rsaKey, ecKey, edKey}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	keys := generateKeys(t)
+
+	for i, k := range keys {
+		key, err := NewSigningKey("key", k)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := Sign(key, "JWT", Claims{Subject: "john", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+		if err != nil {
+			t.Fatalf("entry #%d: %s", i, err)
+		}
+
+		tk, err := Parse(s)
+		if err != nil {
+			t.Fatalf("entry #%d: %s", i, err)
+		}
+		if tk.Header.Algorithm != key.Algorithm || tk.Header.KeyID != "key" {
+			t.Errorf("entry #%d: unexpected header %#v", i, tk.Header)
+		}
+
+		if err := tk.Verify(key.Public()); err != nil {
+			t.Errorf("entry #%d: %s", i, err)
+		}
+
+		// Verifying against a key of another type or another key of the same type must fail.
+		other := keys[(i+1)%len(keys)].Public()
+		if err := tk.Verify(other); err == nil {
+			t.Errorf("entry #%d: token verified with unrelated key", i)
+		}
+
+		var claims Claims
+		if err := tk.Claims(&claims); err != nil {
+			t.Fatal(err)
+		}
+		if claims.Subject != "john" {
+			t.Errorf("entry #%d: unexpected subject %s", i, claims.Subject)
+		}
+		if err := claims.Validate(time.Now(), 0); err != nil {
+			t.Errorf("entry #%d: %s", i, err)
+		}
+		if err := claims.Validate(time.Now().Add(time.Hour), 0); err != ErrExpired {
+			t.Errorf("entry #%d: expected token to be expired", i)
+		}
+	}
+
+	if _, err := Parse("not.a-token"); err != ErrMalformed {
+		t.Errorf("expected malformed token error, got %v", err)
+	}
+}
+
+func TestSignHMAC(t *testing.T) {
+	s, err := SignHMAC([]byte("secret"), "", Claims{Subject: "john"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tk, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Header.Algorithm != HS256 {
+		t.Fatalf("unexpected algorithm %s", tk.Header.Algorithm)
+	}
+
+	if err := tk.Verify([]byte("secret")); err != nil {
+		t.Error(err)
+	}
+	if err := tk.Verify([]byte("other")); err != ErrInvalidSignature {
+		t.Errorf("expected invalid signature, got %v", err)
+	}
+
+	// A token signed with HMAC must never verify against a public key.
+	for i, k := range generateKeys(t) {
+		if err := tk.Verify(k.Public()); err == nil {
+			t.Errorf("entry #%d: HMAC token verified with public key", i)
+		}
+	}
+}
+
+func TestJSONWebKeyMarshaling(t *testing.T) {
+	for i, k := range generateKeys(t) {
+		key, err := NewSigningKey("key", k)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := json.Marshal(JSONWebKeySet{Keys: []JSONWebKey{NewJSONWebKey(key)}})
+		if err != nil {
+			t.Fatalf("entry #%d: %s", i, err)
+		}
+
+		var set JSONWebKeySet
+		if err := json.Unmarshal(b, &set); err != nil {
+			t.Fatalf("entry #%d: %s", i, err)
+		}
+
+		jwk := set.Key("key")
+		if jwk == nil || jwk.Algorithm != key.Algorithm {
+			t.Fatalf("entry #%d: key not found in %s", i, b)
+		}
+
+		s, err := Sign(key, "", Claims{Subject: "john"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tk, err := Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tk.Verify(jwk.Key); err != nil {
+			t.Errorf("entry #%d: unmarshaled key can't verify signature: %s", i, err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package security
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	ErrInvalidHash     = errors.New("invalid password hash")
+	ErrUnsupportedHash = errors.New("unsupported password hash algorithm")
+)
+
+// PasswordHasher is the interface for password hashing algorithms. Hashes are encoded using the PHC
+// string format (https://github.com/P-H-C/phc-string-format/blob/master/phc-sf-spec.md), except for
+// bcrypt which uses it's own modular crypt format, so the algorithm and parameters are stored along
+// with the hash.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password, using a random salt.
+	Hash(password []byte) (string, error)
+
+	// Verify returns whether the password matches the encoded hash.
+	Verify(encoded string, password []byte) (bool, error)
+
+	// Supports returns whether the encoded hash was produced by this algorithm.
+	Supports(encoded string) bool
+
+	// NeedsRehash returns whether the encoded hash was produced with other parameters than the
+	// current ones.
+	NeedsRehash(encoded string) bool
+}
+
+// PasswordHashers verifies passwords against hashes produced by any of it's hashers, while new
+// passwords are always hashed using the first one.
+type PasswordHashers []PasswordHasher
+
+// DefaultPasswordHashers hashes passwords using argon2id, while still verifying scrypt and bcrypt
+// hashes.
+var DefaultPasswordHashers = PasswordHashers{
+	DefaultArgon2idHasher,
+	DefaultScryptHasher,
+	DefaultBcryptHasher,
+}
+
+// Hash returns the encoded hash of the password using the preferred hasher.
+func (hs PasswordHashers) Hash(password []byte) (string, error) {
+	if len(hs) == 0 {
+		return "", ErrUnsupportedHash
+	}
+
+	return hs[0].Hash(password)
+}
+
+// Verify returns whether the password matches the encoded hash. When it does, it also returns
+// whether the hash should be replaced by a new one, because it was produced by another algorithm
+// than the preferred one or with outdated parameters.
+func (hs PasswordHashers) Verify(encoded string, password []byte) (match bool, rehash bool, err error) {
+	for i, h := range hs {
+		if !h.Supports(encoded) {
+			continue
+		}
+
+		match, err := h.Verify(encoded, password)
+		if err != nil || !match {
+			return false, false, err
+		}
+
+		return true, i != 0 || h.NeedsRehash(encoded), nil
+	}
+
+	return false, false, ErrUnsupportedHash
+}
+
+// Argon2idHasher hashes passwords using argon2id, as defined by https://tools.ietf.org/html/rfc9106
+type Argon2idHasher struct {
+	Time       uint32
+	Memory     uint32 // in KiB
+	Threads    uint8
+	SaltLength uint16
+	KeyLength  uint32
+}
+
+// DefaultArgon2idHasher uses the parameters recommended by https://tools.ietf.org/html/rfc9106#section-4
+var DefaultArgon2idHasher = Argon2idHasher{Time: 3, Memory: 64 * 1024, Threads: 4, SaltLength: 16, KeyLength: 32}
+
+// Hash returns the PHC encoded argon2id hash of the password.
+func (h Argon2idHasher) Hash(password []byte) (string, error) {
+	salt, err := Random(h.SaltLength)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey(password, salt, h.Time, h.Memory, h.Threads, h.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Time, h.Threads, encodePHC(salt), encodePHC(key)), nil
+}
+
+// Verify returns whether the password matches the PHC encoded argon2id hash.
+func (h Argon2idHasher) Verify(encoded string, password []byte) (bool, error) {
+	p, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey(password, p.salt, uint32(p.params["t"]), uint32(p.params["m"]), uint8(p.params["p"]), uint32(len(p.hash)))
+	return Compare(key, p.hash), nil
+}
+
+// Supports returns whether the encoded hash is an argon2id hash.
+func (h Argon2idHasher) Supports(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+// NeedsRehash returns whether the hash parameters differ from the hasher ones.
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return p.params["m"] != uint64(h.Memory) ||
+		p.params["t"] != uint64(h.Time) ||
+		p.params["p"] != uint64(h.Threads) ||
+		len(p.salt) != int(h.SaltLength) ||
+		len(p.hash) != int(h.KeyLength)
+}
+
+// parseArgon2id parses the PHC encoded argon2id hash, rejecting versions and parameters argon2id
+// can't be computed with, as defined by https://tools.ietf.org/html/rfc9106#section-3.1
+func parseArgon2id(encoded string) (*phcHash, error) {
+	p, err := parsePHC(encoded, "argon2id", "m", "t", "p")
+	if err != nil {
+		return nil, err
+	}
+
+	if p.version != argon2.Version ||
+		p.params["t"] < 1 ||
+		p.params["p"] < 1 || p.params["p"] > 255 ||
+		p.params["m"] < 8*p.params["p"] ||
+		len(p.hash) < 4 {
+		return nil, ErrInvalidHash
+	}
+
+	return p, nil
+}
+
+// ScryptHasher hashes passwords using scrypt, as defined by https://tools.ietf.org/html/rfc7914
+type ScryptHasher struct {
+	LogN       uint8
+	R          int
+	P          int
+	SaltLength uint16
+	KeyLength  int
+}
+
+// DefaultScryptHasher uses the parameters recommended for interactive logins.
+var DefaultScryptHasher = ScryptHasher{LogN: 15, R: 8, P: 1, SaltLength: 16, KeyLength: 32}
+
+// Hash returns the PHC encoded scrypt hash of the password.
+func (h ScryptHasher) Hash(password []byte) (string, error) {
+	salt, err := Random(h.SaltLength)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := scrypt.Key(password, salt, 1<<h.LogN, h.R, h.P, h.KeyLength)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.LogN, h.R, h.P, encodePHC(salt), encodePHC(key)), nil
+}
+
+// Verify returns whether the password matches the PHC encoded scrypt hash.
+func (h ScryptHasher) Verify(encoded string, password []byte) (bool, error) {
+	p, err := parsePHC(encoded, "scrypt", "ln", "r", "p")
+	if err != nil {
+		return false, err
+	}
+	if p.params["ln"] > 62 {
+		return false, ErrInvalidHash
+	}
+
+	key, err := scrypt.Key(password, p.salt, 1<<p.params["ln"], int(p.params["r"]), int(p.params["p"]), len(p.hash))
+	if err != nil {
+		return false, ErrInvalidHash
+	}
+
+	return Compare(key, p.hash), nil
+}
+
+// Supports returns whether the encoded hash is a scrypt hash.
+func (h ScryptHasher) Supports(encoded string) bool {
+	return strings.HasPrefix(encoded, "$scrypt$")
+}
+
+// NeedsRehash returns whether the hash parameters differ from the hasher ones.
+func (h ScryptHasher) NeedsRehash(encoded string) bool {
+	p, err := parsePHC(encoded, "scrypt", "ln", "r", "p")
+	if err != nil {
+		return true
+	}
+
+	return p.params["ln"] != uint64(h.LogN) ||
+		p.params["r"] != uint64(h.R) ||
+		p.params["p"] != uint64(h.P) ||
+		len(p.salt) != int(h.SaltLength) ||
+		len(p.hash) != h.KeyLength
+}
+
+// BcryptHasher hashes passwords using bcrypt. Since bcrypt only uses the first 72 bytes of a
+// password, longer passwords are rejected.
+type BcryptHasher struct {
+	Cost int
+}
+
+// DefaultBcryptHasher uses a cost of 12.
+var DefaultBcryptHasher = BcryptHasher{Cost: 12}
+
+// Hash returns the bcrypt hash of the password.
+func (h BcryptHasher) Hash(password []byte) (string, error) {
+	b, err := bcrypt.GenerateFromPassword(password, h.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Verify returns whether the password matches the bcrypt hash.
+func (h BcryptHasher) Verify(encoded string, password []byte) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, ErrInvalidHash
+	}
+
+	return true, nil
+}
+
+// Supports returns whether the encoded hash is a bcrypt hash.
+func (h BcryptHasher) Supports(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// NeedsRehash returns whether the hash cost differs from the hasher one.
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// phcHash is a parsed PHC string: $<id>[$v=<version>][$<param>=<value>(,<param>=<value>)*]$<salt>$<hash>
+type phcHash struct {
+	version uint64
+	params  map[string]uint64
+	salt    []byte
+	hash    []byte
+}
+
+// parsePHC parses the PHC string for the algorithm id, requiring the provided numeric parameters.
+func parsePHC(encoded, id string, required ...string) (*phcHash, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) < 4 || fields[0] != "" || fields[1] != id {
+		return nil, ErrInvalidHash
+	}
+	fields = fields[2:]
+
+	var (
+		p   = phcHash{params: make(map[string]uint64)}
+		err error
+	)
+
+	if strings.HasPrefix(fields[0], "v=") {
+		if p.version, err = strconv.ParseUint(fields[0][2:], 10, 32); err != nil {
+			return nil, ErrInvalidHash
+		}
+		fields = fields[1:]
+	}
+	switch len(fields) {
+	case 2:
+	case 3:
+		for _, param := range strings.Split(fields[0], ",") {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 {
+				return nil, ErrInvalidHash
+			}
+			if p.params[kv[0]], err = strconv.ParseUint(kv[1], 10, 32); err != nil {
+				return nil, ErrInvalidHash
+			}
+		}
+		fields = fields[1:]
+	default:
+		return nil, ErrInvalidHash
+	}
+	for _, r := range required {
+		if _, ok := p.params[r]; !ok {
+			return nil, ErrInvalidHash
+		}
+	}
+
+	if p.salt, err = decodePHC(fields[0]); err != nil {
+		return nil, ErrInvalidHash
+	}
+	if p.hash, err = decodePHC(fields[1]); err != nil || len(p.hash) == 0 {
+		return nil, ErrInvalidHash
+	}
+
+	return &p, nil
+}
+
+// encodePHC encodes binary values using the unpadded standard base64 encoding required by PHC.
+func encodePHC(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func decodePHC(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(s)
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package security
+
+import (
+	"testing"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	// Cheap parameters, so the test runs fast.
+	table := []PasswordHasher{
+		Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, SaltLength: 16, KeyLength: 32},
+		ScryptHasher{LogN: 10, R: 8, P: 1, SaltLength: 16, KeyLength: 32},
+		BcryptHasher{Cost: 4},
+	}
+
+	for i, h := range table {
+		encoded, err := h.Hash([]byte("password"))
+		if err != nil {
+			t.Fatalf("entry #%d: %s", i, err)
+		}
+
+		if !h.Supports(encoded) {
+			t.Errorf("entry #%d: hasher doesn't support it's own hash %s", i, encoded)
+		}
+		if h.NeedsRehash(encoded) {
+			t.Errorf("entry #%d: hash %s needs rehash with the same parameters", i, encoded)
+		}
+
+		if ok, err := h.Verify(encoded, []byte("password")); !ok || err != nil {
+			t.Errorf("entry #%d: expected password to match %s (%v)", i, encoded, err)
+		}
+		if ok, err := h.Verify(encoded, []byte("wrong")); ok || err != nil {
+			t.Errorf("entry #%d: expected wrong password not to match %s (%v)", i, encoded, err)
+		}
+
+		// Hashes produced by hashers other than the preferred one need to be rehashed.
+		hs := PasswordHashers{table[(i+1)%len(table)], h}
+		match, rehash, err := hs.Verify(encoded, []byte("password"))
+		if err != nil || !match || !rehash {
+			t.Errorf("entry #%d: expected match and rehash, got %t %t (%v)", i, match, rehash, err)
+		}
+	}
+
+	outdated, err := Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, SaltLength: 16, KeyLength: 32}.Hash([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(Argon2idHasher{Time: 2, Memory: 1024, Threads: 1, SaltLength: 16, KeyLength: 32}).NeedsRehash(outdated) {
+		t.Error("expected hash with outdated parameters to need rehash")
+	}
+
+	// Parameters argon2id can't be computed with are rejected instead of being used.
+	for _, encoded := range []string{
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaA",
+		"$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaA",
+		"$argon2id$v=19$m=1024,t=1,p=256$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaA",
+		"$argon2id$v=19$m=4,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaA",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGE",
+	} {
+		if ok, err := DefaultArgon2idHasher.Verify(encoded, []byte("password")); ok || err != ErrInvalidHash {
+			t.Errorf("expected invalid hash error for %s, got %t %v", encoded, ok, err)
+		}
+	}
+
+	if _, _, err := DefaultPasswordHashers.Verify("$unknown$abc$def", []byte("password")); err != ErrUnsupportedHash {
+		t.Errorf("expected unsupported hash error, got %v", err)
+	}
+}
+
+func TestHashSecret(t *testing.T) {
+	secret, err := Random(128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := HashSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !VerifySecret(encoded, secret) {
+		t.Errorf("expected secret to match %s", encoded)
+	}
+	if VerifySecret(encoded, secret[1:]) {
+		t.Errorf("expected wrong secret not to match %s", encoded)
+	}
+	if VerifySecret("$hmac-sha256$invalid", secret) {
+		t.Error("expected invalid hash not to match")
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2015 Rodrigo Rafael Monti Kochenburger
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// HashSecret returns the PHC encoded salted HMAC-SHA256 hash of a randomly generated secret.
+//
+// Unlike passwords, generated secrets have enough entropy to make brute forcing infeasible, so a
+// fast hash is enough and keeps authenticating clients cheap. It must not be used for passwords.
+func HashSecret(secret []byte) (string, error) {
+	salt, err := Random(16)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("$hmac-sha256$%s$%s", encodePHC(salt), encodePHC(hmacSHA256(salt, secret))), nil
+}
+
+// VerifySecret returns whether the secret matches the encoded hash produced by HashSecret.
+func VerifySecret(encoded string, secret []byte) bool {
+	p, err := parsePHC(encoded, "hmac-sha256")
+	if err != nil {
+		return false
+	}
+
+	return Compare(hmacSHA256(p.salt, secret), p.hash)
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}